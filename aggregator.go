@@ -1,11 +1,42 @@
 package metrik
 
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
 //Aggregator reduces a list of values to a single value.
 type Aggregator interface {
 	Apply([]float64) float64
 	ApplyMany([][]float64) float64
 }
 
+//PointAggregator is an Aggregator that needs the points themselves, for example to read their tags,
+//rather than just their values. The index calls ApplyPoints instead of Apply when it can.
+type PointAggregator interface {
+	Aggregator
+	ApplyPoints(Points) float64
+}
+
+//defaultAggregates returns the aggregates that are registered by every server, by name.
+func defaultAggregates() map[string]Aggregator {
+	return map[string]Aggregator{
+		"sum":      sum{},
+		"average":  avg{},
+		"count":    count{},
+		"min":      minimum{},
+		"max":      maximum{},
+		"median":   Percentile(50),
+		"p50":      Percentile(50),
+		"p95":      Percentile(95),
+		"p99":      Percentile(99),
+		"variance": variance{},
+		"stddev":   stddev{},
+	}
+}
+
 type count struct{}
 
 func (c count) Apply(vals []float64) float64 {
@@ -64,5 +95,232 @@ func (a avg) ApplyMany(valLists [][]float64) float64 {
 		ssum += s.Apply(vals)
 		count += float64(len(vals))
 	}
+	if count == 0 {
+		return 0
+	}
 	return ssum / count
 }
+
+type minimum struct{}
+
+func (m minimum) Apply(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	ret := vals[0]
+	for _, val := range vals[1:] {
+		if val < ret {
+			ret = val
+		}
+	}
+	return ret
+}
+
+func (m minimum) ApplyMany(valLists [][]float64) float64 {
+	return m.Apply(flatten(valLists))
+}
+
+type maximum struct{}
+
+func (m maximum) Apply(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	ret := vals[0]
+	for _, val := range vals[1:] {
+		if val > ret {
+			ret = val
+		}
+	}
+	return ret
+}
+
+func (m maximum) ApplyMany(valLists [][]float64) float64 {
+	return m.Apply(flatten(valLists))
+}
+
+//Percentile returns an aggregator that computes the p-th percentile (0 <= p <= 100) of the values,
+//interpolating linearly between the closest ranks. Percentile(50) is the median.
+func Percentile(p float64) Aggregator {
+	return percentile{p: p}
+}
+
+type percentile struct {
+	p float64
+}
+
+func (pc percentile) Apply(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(vals))
+	copy(sorted, vals)
+	sort.Float64s(sorted)
+	rank := pc.p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower < 0 {
+		return sorted[0]
+	}
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
+}
+
+//ApplyMany computes the percentile over the values of all the lists together: percentiles of
+//separate lists can't be combined.
+func (pc percentile) ApplyMany(valLists [][]float64) float64 {
+	return pc.Apply(flatten(valLists))
+}
+
+//variance is the population variance of the values.
+type variance struct{}
+
+func (v variance) Apply(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	mean := avg{}.Apply(vals)
+	var ssq float64
+	for _, val := range vals {
+		ssq += (val - mean) * (val - mean)
+	}
+	return ssq / float64(len(vals))
+}
+
+func (v variance) ApplyMany(valLists [][]float64) float64 {
+	return v.Apply(flatten(valLists))
+}
+
+//stddev is the population standard deviation of the values.
+type stddev struct{}
+
+func (s stddev) Apply(vals []float64) float64 {
+	return math.Sqrt(variance{}.Apply(vals))
+}
+
+func (s stddev) ApplyMany(valLists [][]float64) float64 {
+	return s.Apply(flatten(valLists))
+}
+
+//WeightedAverage returns an aggregator that computes the average of the values weighted by a numeric
+//tag, for example a capacity-weighted average with WeightedAverage("capacity_kw"). Points without
+//a numeric value for the tag have no weight. Given values only (Apply), it is the plain average.
+func WeightedAverage(tag string) PointAggregator {
+	return weightedAvg{weight: func(p Point) (float64, bool) {
+		if values := p.Tags[tag]; len(values) > 0 {
+			w, err := strconv.ParseFloat(values[0], 64)
+			return w, err == nil
+		}
+		return 0, false
+	}}
+}
+
+//WeightedAverageByMetric returns an aggregator that computes the average of the values weighted by the
+//value of another metric at the time of the snapshot. The points of the two metrics are matched by the
+//value of the key tag, for example WeightedAverageByMetric("capacity", "asset") weights the power of
+//each asset by its capacity. Points that have no match have no weight. It must be registered with
+//Server.Aggregate, which gives it access to the other metric.
+func WeightedAverageByMetric(metric string, key string) PointAggregator {
+	return &metricWeightedAvg{metric: metric, key: key}
+}
+
+type weightedAvg struct {
+	weight func(Point) (float64, bool)
+}
+
+func (w weightedAvg) Apply(vals []float64) float64 {
+	return avg{}.Apply(vals)
+}
+
+func (w weightedAvg) ApplyMany(valLists [][]float64) float64 {
+	return avg{}.ApplyMany(valLists)
+}
+
+func (w weightedAvg) ApplyPoints(points Points) float64 {
+	var wsum, sumw float64
+	for _, p := range points {
+		if weight, ok := w.weight(p); ok {
+			wsum += weight * p.Value
+			sumw += weight
+		}
+	}
+	if sumw == 0 {
+		return 0
+	}
+	return wsum / sumw
+}
+
+//snapshotAggregator is implemented by the aggregators that depend on the snapshots of other metrics.
+//at returns the aggregator to apply to the snapshots taken at t.
+type snapshotAggregator interface {
+	at(t time.Time) Aggregator
+}
+
+//aggregatorAt returns the aggregator to apply to the snapshots taken at t. Handlers call it once
+//per snapshot, so that what the aggregator depends on is only looked up once.
+func aggregatorAt(a Aggregator, t time.Time) Aggregator {
+	if sa, ok := a.(snapshotAggregator); ok {
+		return sa.at(t)
+	}
+	return a
+}
+
+type metricWeightedAvg struct {
+	weightedAvg
+	metric  string
+	key     string
+	indexAt func(metric string, t time.Time) (invertedIndex, bool) //set by Server.Aggregate
+}
+
+//bind gives the aggregator access to the snapshots of the server's metrics.
+func (m *metricWeightedAvg) bind(s *Server) {
+	m.indexAt = s.indexAt
+}
+
+func (m *metricWeightedAvg) at(t time.Time) Aggregator {
+	return m.weightedAt(t)
+}
+
+//weightedAt returns the average weighted by the snapshot of the other metric in effect at t.
+func (m *metricWeightedAvg) weightedAt(t time.Time) weightedAvg {
+	if m.indexAt == nil {
+		//not registered with a server, so every point has the same weight
+		return weightedAvg{weight: func(Point) (float64, bool) {
+			return 1, true
+		}}
+	}
+	index, _ := m.indexAt(m.metric, t)
+	weights := make(map[string]float64, len(index.Points))
+	for _, p := range index.Points {
+		if values := p.Tags[m.key]; len(values) > 0 {
+			weights[values[0]] = p.Value
+		}
+	}
+	return weightedAvg{weight: func(p Point) (float64, bool) {
+		if values := p.Tags[m.key]; len(values) > 0 {
+			w, ok := weights[values[0]]
+			return w, ok
+		}
+		return 0, false
+	}}
+}
+
+//ApplyPoints weights the points by the latest snapshot of the other metric.
+func (m *metricWeightedAvg) ApplyPoints(points Points) float64 {
+	return m.weightedAt(time.Now()).ApplyPoints(points)
+}
+
+//flatten concatenates the lists.
+func flatten(valLists [][]float64) []float64 {
+	var n int
+	for _, vals := range valLists {
+		n += len(vals)
+	}
+	ret := make([]float64, 0, n)
+	for _, vals := range valLists {
+		ret = append(ret, vals...)
+	}
+	return ret
+}
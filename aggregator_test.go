@@ -0,0 +1,133 @@
+package metrik
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrderStatistics(t *testing.T) {
+	vals := []float64{7, 1, 3, 9, 5}
+	lists := [][]float64{{7, 1}, {}, {3, 9, 5}}
+	for name, expected := range map[string]float64{
+		"min":    1,
+		"max":    9,
+		"median": 5,
+		"p50":    5,
+		"p95":    8.6,
+		"p99":    8.92,
+	} {
+		a := defaultAggregates()[name]
+		if val := a.Apply(vals); !approxEqual(val, expected) {
+			t.Errorf("expected %s to be %v, instead got %v", name, expected, val)
+		}
+		if val := a.ApplyMany(lists); !approxEqual(val, expected) {
+			t.Errorf("expected %s of many lists to be %v, instead got %v", name, expected, val)
+		}
+		if val := a.Apply(nil); val != 0 {
+			t.Errorf("expected %s of no values to be 0, instead got %v", name, val)
+		}
+	}
+	//the median of many lists isn't the median of their medians
+	if val := Percentile(50).ApplyMany([][]float64{{1, 2, 3}, {4}, {5}}); val != 3 {
+		t.Errorf("expected median to be 3, instead got %v", val)
+	}
+	if val := Percentile(50).Apply([]float64{1, 2, 3, 4}); val != 2.5 {
+		t.Errorf("expected median to be interpolated to 2.5, instead got %v", val)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	vals := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	lists := [][]float64{{2, 4, 4}, {4, 5}, {}, {5, 7, 9}}
+	for name, expected := range map[string]float64{"variance": 4, "stddev": 2} {
+		a := defaultAggregates()[name]
+		if val := a.Apply(vals); !approxEqual(val, expected) {
+			t.Errorf("expected %s to be %v, instead got %v", name, expected, val)
+		}
+		if val := a.ApplyMany(lists); !approxEqual(val, expected) {
+			t.Errorf("expected %s of many lists to be %v, instead got %v", name, expected, val)
+		}
+		if val := a.Apply(nil); val != 0 {
+			t.Errorf("expected %s of no values to be 0, instead got %v", name, val)
+		}
+	}
+}
+
+func capacityIndex() invertedIndex {
+	index := newInvertedIndex()
+	index.Index(Points{
+		{Tags: Tags{"region": {"uk"}, "asset": {"a"}, "capacity_kw": {"10"}}, Value: 1},
+		{Tags: Tags{"region": {"uk"}, "asset": {"b"}, "capacity_kw": {"30"}}, Value: 3},
+		{Tags: Tags{"region": {"fr"}, "asset": {"c"}, "capacity_kw": {"unknown"}}, Value: 100},
+		{Tags: Tags{"region": {"fr"}, "asset": {"d"}, "capacity_kw": {"20"}}, Value: 2},
+	})
+	return index
+}
+
+func TestWeightedAverage(t *testing.T) {
+	a := WeightedAverage("capacity_kw")
+	if val := a.Apply([]float64{1, 3}); val != 2 {
+		t.Errorf("expected weighted average of values only to be the average 2, instead got %v", val)
+	}
+	if val := a.ApplyMany([][]float64{{1}, {2, 3}}); val != 2 {
+		t.Errorf("expected weighted average of many lists of values only to be the average 2, instead got %v", val)
+	}
+
+	index := capacityIndex()
+	//(1*10 + 3*30 + 2*20) / 60, the point without a numeric capacity has no weight
+	if val, _ := index.GetTotalAggregate(a, nil); !approxEqual(val, 140.0/60) {
+		t.Errorf("expected weighted average to be 2.333, instead got %v", val)
+	}
+	if val, _ := index.GetTotalAggregate(a, matchTags(Tags{"region": {"uk"}})); val != 2.5 {
+		t.Errorf("expected weighted average in uk to be 2.5, instead got %v", val)
+	}
+	groups, _ := index.GetGroupByAggregate("region", a, nil)
+	for _, g := range groups {
+		if expected := map[string]float64{"uk": 2.5, "fr": 2}[g.Key]; g.Value != expected {
+			t.Errorf("expected weighted average in %s to be %v, instead got %v", g.Key, expected, g.Value)
+		}
+	}
+}
+
+func TestWeightedAverageByMetric(t *testing.T) {
+	s := NewServer()
+	s.Metric(&Metric{Name: "capacity"})
+	a := WeightedAverageByMetric("capacity", "asset")
+	if val := a.ApplyPoints(Points{{Value: 1}, {Value: 2}}); val != 1.5 {
+		t.Errorf("expected unregistered weighted average to be the average 1.5, instead got %v", val)
+	}
+	s.Aggregate(a, "wavg")
+	if val := a.ApplyPoints(Points{{Value: 1}}); val != 0 {
+		t.Errorf("expected weighted average without weights to be 0, instead got %v", val)
+	}
+
+	capacity := newInvertedIndex()
+	capacity.Index(Points{
+		{Tags: Tags{"asset": {"a"}}, Value: 10},
+		{Tags: Tags{"asset": {"b"}}, Value: 30},
+	})
+	s._history["capacity"].Append(capacity)
+	index := capacityIndex()
+	if val, _ := index.GetTotalAggregate(a, nil); val != 2.5 {
+		t.Errorf("expected weighted average to be 2.5, instead got %v", val)
+	}
+
+	//historical snapshots are weighted by the capacity at the time
+	t0 := time.Now().Add(-time.Hour)
+	earlier := newInvertedIndex()
+	earlier.Index(Points{
+		{Tags: Tags{"asset": {"a"}}, Value: 30},
+		{Tags: Tags{"asset": {"b"}}, Value: 10},
+	})
+	s._history["capacity"].Insert(t0, earlier)
+	if val, _ := index.GetTotalAggregate(aggregatorAt(a, t0.Add(time.Minute)), nil); val != 1.5 {
+		t.Errorf("expected weighted average an hour ago to be 1.5, instead got %v", val)
+	}
+	if val, _ := index.GetTotalAggregate(aggregatorAt(a, t0.Add(-time.Minute)), nil); val != 0 {
+		t.Errorf("expected weighted average before the first capacity snapshot to be 0, instead got %v", val)
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
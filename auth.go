@@ -1,11 +1,14 @@
 package metrik
 
 //AuthRequest represents an authorization request. Credentials are passed through HTTP Basic Auth headers.
+//POST /write is authorized twice: first without metrics, before its body is read, then with the metrics
+//of its points.
 type AuthRequest struct {
 	User     string
 	Password string
 	Metrics  []string
 	Tags     []string
+	Write    bool //True if the request publishes points (eg. POST /ingest/:metric) rather than querying them
 }
 
 //AuthError represents an authentication error.
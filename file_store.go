@@ -0,0 +1,230 @@
+package metrik
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//ErrCorrupt is returned (wrapped) by FileStore.Get when a value fails its integrity checks.
+var ErrCorrupt = errors.New("corrupt value")
+
+const (
+	fileStoreMagic   = "MTRK"
+	fileStoreVersion = 1
+	fileStoreExt     = ".val"
+	fileStoreTmpExt  = ".tmp"
+	//magic, version, crc32 of the value, length of the value
+	fileStoreHeaderSize = len(fileStoreMagic) + 1 + 4 + 8
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//FileStore is a Store that persists each key as a file in a directory, so that snapshots survive
+//restarts without an external database.
+//
+//Writes are atomic: the value is written to a temporary file that is fsynced and then renamed over
+//the previous value, so a crash leaves either the old or the new value behind. Every value is stored
+//with a checksum, and Get returns an error wrapping ErrCorrupt if it doesn't match.
+//Keys are hex-encoded to make file names, which preserves their order, so they should be shorter
+//than 120 bytes or so.
+type FileStore struct {
+	dir string
+}
+
+//NewFileStore creates a store that keeps its files in dir. The directory is created by Initialize if
+//it doesn't exist.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+//Initialize creates the store directory if needed and removes any temporary files left behind by
+//writes that were interrupted by a crash.
+func (f *FileStore) Initialize(...interface{}) error {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+	tmps, err := filepath.Glob(filepath.Join(f.dir, "*"+fileStoreTmpExt))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileStore) path(key []byte) string {
+	return filepath.Join(f.dir, hex.EncodeToString(key)+fileStoreExt)
+}
+
+//Put atomically replaces the value of the key.
+func (f *FileStore) Put(key []byte, val []byte) error {
+	tmp, err := os.CreateTemp(f.dir, hex.EncodeToString(key)+".*"+fileStoreTmpExt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //no-op once renamed
+
+	header := make([]byte, fileStoreHeaderSize)
+	copy(header, fileStoreMagic)
+	header[len(fileStoreMagic)] = fileStoreVersion
+	binary.BigEndian.PutUint32(header[len(fileStoreMagic)+1:], crc32.Checksum(val, castagnoli))
+	binary.BigEndian.PutUint64(header[len(fileStoreMagic)+5:], uint64(len(val)))
+
+	if _, err := tmp.Write(header); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(val); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path(key)); err != nil {
+		return err
+	}
+	return f.syncDir()
+}
+
+//syncDir makes sure renames in the store directory are durable.
+func (f *FileStore) syncDir() error {
+	d, err := os.Open(f.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+//Get retrieves the value of the key, or nil if it doesn't exist.
+func (f *FileStore) Get(key []byte) ([]byte, error) {
+	b, err := os.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeFileStoreValue(key, b)
+}
+
+func decodeFileStoreValue(key []byte, b []byte) ([]byte, error) {
+	if len(b) < fileStoreHeaderSize || !bytes.Equal(b[:len(fileStoreMagic)], []byte(fileStoreMagic)) {
+		return nil, fmt.Errorf("%w: bad header for key %q", ErrCorrupt, key)
+	}
+	if v := b[len(fileStoreMagic)]; v != fileStoreVersion {
+		return nil, fmt.Errorf("%w: unknown version %v for key %q", ErrCorrupt, v, key)
+	}
+	checksum := binary.BigEndian.Uint32(b[len(fileStoreMagic)+1:])
+	length := binary.BigEndian.Uint64(b[len(fileStoreMagic)+5:])
+	val := b[fileStoreHeaderSize:]
+	if uint64(len(val)) != length {
+		return nil, fmt.Errorf("%w: expected %v bytes for key %q, found %v", ErrCorrupt, length, key, len(val))
+	}
+	if crc32.Checksum(val, castagnoli) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch for key %q", ErrCorrupt, key)
+	}
+	return val, nil
+}
+
+//Delete removes the key.
+func (f *FileStore) Delete(key []byte) error {
+	if err := os.Remove(f.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.syncDir()
+}
+
+//Keys lists the keys starting with the prefix, in increasing order.
+func (f *FileStore) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := f.scan(func(key []byte) bool {
+		if bytes.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+//Range calls the function on every key-value pair with start <= key < end, in increasing order of
+//keys, until it returns false. It stops with an error wrapping ErrCorrupt if a value is corrupt.
+func (f *FileStore) Range(start []byte, end []byte, fn func([]byte, []byte) bool) error {
+	var keys [][]byte
+	err := f.scan(func(key []byte) bool {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return false
+		}
+		if inRange(key, start, end) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		val, err := f.Get(key)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			//deleted since we listed the keys
+			continue
+		}
+		if !fn(key, val) {
+			break
+		}
+	}
+	return nil
+}
+
+//scan calls the function on every key in the store, in increasing order, until it returns false.
+func (f *FileStore) scan(fn func([]byte) bool) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	//entries are sorted by file name, and hex encoding preserves the order of keys
+	for _, entry := range entries {
+		key, ok := keyFromFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		if !fn(key) {
+			break
+		}
+	}
+	return nil
+}
+
+//Close is a no-op: the store doesn't keep any files open between operations.
+func (f *FileStore) Close() error {
+	return nil
+}
+
+//keyFromFileName decodes the key from the name of a value file.
+func keyFromFileName(name string) ([]byte, bool) {
+	if !strings.HasSuffix(name, fileStoreExt) {
+		return nil, false
+	}
+	key, err := hex.DecodeString(strings.TrimSuffix(name, fileStoreExt))
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
@@ -0,0 +1,402 @@
+package metrik
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//type tagFilter selects the points matching all of its predicates. A nil or empty filter
+//selects every point.
+type tagFilter []tagPredicate
+
+//type tagPredicate matches the points tagged with any of its values, or a value matching any of its
+//patterns, for the key. If All is set they must match every value and pattern instead. If Negate
+//is set it matches the other points. If Op is set (<, <=, > or >=), it instead matches the points
+//tagged with a number that compares to Bound.
+type tagPredicate struct {
+	Key      string
+	Values   []string
+	Patterns []*regexp.Regexp
+	All      bool
+	Negate   bool
+	Op       string
+	Bound    float64
+}
+
+func (p tagPredicate) terms() int {
+	return len(p.Values) + len(p.Patterns)
+}
+
+//matches returns true if val is one of the values of the predicate or matches one of its patterns,
+//or if it is a number satisfying the comparison.
+func (p tagPredicate) matches(val string) bool {
+	if p.Op != "" {
+		v, err := strconv.ParseFloat(val, 64)
+		return err == nil && compare(v, p.Op, p.Bound)
+	}
+	if isIn(p.Values, val) {
+		return true
+	}
+	for _, re := range p.Patterns {
+		if re.MatchString(val) {
+			return true
+		}
+	}
+	return false
+}
+
+//admits returns false if the predicate can't match a point tagged with val. The group-by
+//queries use it to skip the groups that the filter excludes.
+func (p tagPredicate) admits(val string) bool {
+	if p.All && p.terms() > 1 {
+		//the points tagged with val may have the other values too
+		return true
+	}
+	return p.matches(val) != p.Negate
+}
+
+func compare(v float64, op string, bound float64) bool {
+	switch op {
+	case "<":
+		return v < bound
+	case "<=":
+		return v <= bound
+	case ">":
+		return v > bound
+	case ">=":
+		return v >= bound
+	case "=":
+		return v == bound
+	case "!=":
+		return v != bound
+	}
+	return false
+}
+
+//leaves returns the leaves of the tag values that the predicate matches, ignoring Negate.
+//Comparisons are answered from the numeric view of the tag values.
+func (ii invertedIndex) leaves(p tagPredicate) []*leaf {
+	var ret []*leaf
+	tg := ii.Tags[p.Key]
+	if p.Op != "" {
+		for _, n := range ii.numeric[p.Key].compare(p.Op, p.Bound) {
+			ret = append(ret, tg[n.Key])
+		}
+		return ret
+	}
+	if len(p.Patterns) == 0 {
+		for _, val := range p.Values {
+			if l, ok := tg[val]; ok {
+				ret = append(ret, l)
+			}
+		}
+		return ret
+	}
+	for val, l := range tg {
+		if p.matches(val) {
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+//add adds a value from the query string to the predicate. Values starting with a tilde are
+//regular expressions (~^uk-), and values ending with an asterisk are prefixes (uk-*).
+func (p *tagPredicate) add(val string) error {
+	switch {
+	case strings.HasPrefix(val, "~"):
+		re, err := regexp.Compile(val[1:])
+		if err != nil {
+			return errors.New("invalid pattern - " + val[1:])
+		}
+		p.Patterns = append(p.Patterns, re)
+	case strings.HasSuffix(val, "*"):
+		p.Patterns = append(p.Patterns, regexp.MustCompile("^"+regexp.QuoteMeta(strings.TrimSuffix(val, "*"))))
+	default:
+		p.Values = append(p.Values, val)
+	}
+	return nil
+}
+
+//admits returns false if a predicate on the tag key can't match a point tagged with val.
+func (f tagFilter) admits(key string, val string) bool {
+	for _, p := range f {
+		if p.Key == key && !p.admits(val) {
+			return false
+		}
+	}
+	return true
+}
+
+//matchTags returns a filter selecting the points tagged with any of the values of each key.
+func matchTags(t Tags) tagFilter {
+	if len(t) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	f := make(tagFilter, len(keys))
+	for i, key := range keys {
+		f[i] = tagPredicate{Key: key, Values: t[key]}
+	}
+	return f
+}
+
+//reservedParams are query parameters that control the query rather than filter by tag. To filter
+//by a tag with one of these names, prefix it with tagPrefix, eg. ?tag:from=london
+var reservedParams = map[string]bool{
+	"at":     true,
+	"from":   true,
+	"to":     true,
+	"reduce": true,
+	"match":  true,
+	"sort":   true,
+	"order":  true,
+	"limit":  true,
+	"having": true,
+	"empty":  true,
+}
+
+//tagPrefix marks a query parameter as a tag filter even if its name is reserved.
+const tagPrefix = "tag:"
+
+//parseFilter parses the tag filter from the query string. Repeating a key matches any of its
+//values (?rack=0&rack=1 is rack 0 or rack 1), unless match=all is given, in which case the points
+//must be tagged with every value. Different keys must all match. A key can be negated with an
+//exclamation mark (?region!=london), and ?rack!in=1,2 excludes a comma-separated list of values.
+//Values can also be regular expressions or prefixes (see tagPredicate.add). Keys can be prefixed
+//with tagPrefix, so that tags can be named like reserved parameters.
+func parseFilter(u *url.URL) (tagFilter, error) {
+	query := u.Query()
+	var all bool
+	switch query.Get("match") {
+	case "", "any":
+	case "all":
+		all = true
+	default:
+		return nil, errors.New("invalid match - use any or all")
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if !reservedParams[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var f tagFilter
+	for _, rawKey := range keys {
+		key := strings.TrimPrefix(rawKey, tagPrefix)
+		if i := strings.IndexAny(key, "<>"); i > 0 {
+			comparisons, err := parseComparisons(key[:i], key[i:], query[rawKey])
+			if err != nil {
+				return nil, err
+			}
+			f = append(f, comparisons...)
+			continue
+		}
+		p := tagPredicate{Key: key, All: all}
+		values := query[rawKey]
+		switch {
+		case strings.HasSuffix(key, "!in"):
+			p.Key, p.Negate, values = strings.TrimSuffix(key, "!in"), true, nil
+			for _, val := range query[rawKey] {
+				values = append(values, strings.Split(val, ",")...)
+			}
+		case strings.HasSuffix(key, "!"):
+			p.Key, p.Negate = strings.TrimSuffix(key, "!"), true
+		}
+		if p.Key == "" {
+			return nil, errors.New("missing tag in filter - " + key)
+		}
+		for _, val := range values {
+			if err := p.add(val); err != nil {
+				return nil, err
+			}
+		}
+		f = append(f, p)
+	}
+	return f, nil
+}
+
+//requestFilter parses the tag filter of a request on the metrics. As reserved parameters are not
+//tag filters, using one that is also a tag key of the metrics is rejected rather than silently
+//returning unfiltered results.
+func (s *Server) requestFilter(u *url.URL, metrics []string) (tagFilter, error) {
+	query := u.Query()
+	for key := range query {
+		if !reservedParams[key] {
+			continue
+		}
+		for _, tag := range s.tags {
+			if tag.Name == key {
+				return nil, errAmbiguousParam(key)
+			}
+		}
+		for _, metric := range metrics {
+			if index, ok := s.latestIndex(metric); ok {
+				if _, ok := index.Tags[key]; ok {
+					return nil, errAmbiguousParam(key)
+				}
+			}
+		}
+	}
+	return parseFilter(u)
+}
+
+func errAmbiguousParam(key string) error {
+	return errors.New("ambiguous parameter - " + key + " is also a tag, use " + tagPrefix + key + " to filter by it")
+}
+
+//parseComparisons parses numeric comparisons such as capacity_kw>=50 (which the query string
+//has as key "capacity_kw>", value "50") or capacity_kw<200 (key "capacity_kw<200", no value).
+func parseComparisons(key string, op string, values []string) (tagFilter, error) {
+	if op == "<" || op == ">" {
+		op += "="
+	} else {
+		op, values = op[:1], []string{op[1:]}
+	}
+	f := make(tagFilter, 0, len(values))
+	for _, val := range values {
+		bound, err := strconv.ParseFloat(val, 64)
+		if err != nil || math.IsNaN(bound) {
+			return nil, errors.New("invalid number in filter - " + key + op + val)
+		}
+		f = append(f, tagPredicate{Key: key, Op: op, Bound: bound})
+	}
+	return f, nil
+}
+
+//match returns the points matching the predicate, or false if no point has the tag key. A negated
+//predicate on a missing key matches every point, as none of them has the values it excludes.
+func (ii invertedIndex) match(p tagPredicate) (*leaf, bool) {
+	if _, ok := ii.Tags[p.Key]; !ok {
+		if p.Negate {
+			all := ii.all()
+			return &all, true
+		}
+		return nil, false
+	}
+	var ret *leaf
+	if p.All && p.terms() > 1 {
+		//intersect the points matching each value and pattern
+		for _, val := range p.Values {
+			ret = ii.intersectTerm(ret, tagPredicate{Key: p.Key, Values: []string{val}})
+		}
+		for _, re := range p.Patterns {
+			ret = ii.intersectTerm(ret, tagPredicate{Key: p.Key, Patterns: []*regexp.Regexp{re}})
+		}
+	} else {
+		ret = ii.unionAll(ii.leaves(p))
+	}
+	if p.Negate {
+		ret = difference(ii.all(), *ret)
+	}
+	return ret, true
+}
+
+//intersectTerm intersects l, unless it is nil, with the points matching the term.
+func (ii invertedIndex) intersectTerm(l *leaf, term tagPredicate) *leaf {
+	matched := ii.unionAll(ii.leaves(term))
+	if l == nil {
+		return matched
+	}
+	return intersect(*l, *matched)
+}
+
+//unionAll returns the points that are in any of the leaves.
+func (ii invertedIndex) unionAll(leaves []*leaf) *leaf {
+	switch len(leaves) {
+	case 0:
+		return &leaf{}
+	case 1:
+		return leaves[0]
+	case 2:
+		return union(*leaves[0], *leaves[1])
+	}
+	var ids []int
+	for _, l := range leaves {
+		ids = append(ids, l.Ids...)
+	}
+	sort.Ints(ids)
+	ret := leaf{
+		Ids:  make([]int, 0, len(ids)),
+		Vals: make([]float64, 0, len(ids)),
+	}
+	for i, id := range ids {
+		if i > 0 && ids[i-1] == id {
+			continue
+		}
+		ret.Ids = append(ret.Ids, id)
+		ret.Vals = append(ret.Vals, ii.Points[id].Value)
+	}
+	return &ret
+}
+
+//all returns every point of the index.
+func (ii invertedIndex) all() leaf {
+	ret := leaf{
+		Ids:  make([]int, len(ii.Points)),
+		Vals: make([]float64, len(ii.Points)),
+	}
+	for i := range ii.Points {
+		ret.Ids[i] = i
+		ret.Vals[i] = ii.Points[i].Value
+	}
+	return ret
+}
+
+//union merges the lists l1 and l2, which are sorted in increasing order, dropping the
+//points that are in both.
+func union(l1, l2 leaf) *leaf {
+	ret := leaf{
+		Ids:  make([]int, 0, len(l1.Ids)+len(l2.Ids)),
+		Vals: make([]float64, 0, len(l1.Ids)+len(l2.Ids)),
+	}
+	var i, j int
+	for i < len(l1.Ids) || j < len(l2.Ids) {
+		switch {
+		case j == len(l2.Ids) || (i < len(l1.Ids) && l1.Ids[i] < l2.Ids[j]):
+			ret.Ids = append(ret.Ids, l1.Ids[i])
+			ret.Vals = append(ret.Vals, l1.Vals[i])
+			i++
+		case i == len(l1.Ids) || l2.Ids[j] < l1.Ids[i]:
+			ret.Ids = append(ret.Ids, l2.Ids[j])
+			ret.Vals = append(ret.Vals, l2.Vals[j])
+			j++
+		default:
+			ret.Ids = append(ret.Ids, l1.Ids[i])
+			ret.Vals = append(ret.Vals, l1.Vals[i])
+			i++
+			j++
+		}
+	}
+	return &ret
+}
+
+//difference returns the points of l1 that aren't in l2. Both lists are sorted in increasing order.
+func difference(l1, l2 leaf) *leaf {
+	ret := leaf{
+		Ids:  make([]int, 0, len(l1.Ids)),
+		Vals: make([]float64, 0, len(l1.Ids)),
+	}
+	var j int
+	for i, id := range l1.Ids {
+		for j < len(l2.Ids) && l2.Ids[j] < id {
+			j++
+		}
+		if j < len(l2.Ids) && l2.Ids[j] == id {
+			continue
+		}
+		ret.Ids = append(ret.Ids, id)
+		ret.Vals = append(ret.Vals, l1.Vals[i])
+	}
+	return &ret
+}
@@ -0,0 +1,178 @@
+package metrik
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	u, _ := url.Parse("/sum/cpu?rack=0&rack=1&region=uk&at=-1h")
+	f, err := parseFilter(u)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := tagFilter{
+		{Key: "rack", Values: []string{"0", "1"}},
+		{Key: "region", Values: []string{"uk"}},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %+v, instead got %+v", expected, f)
+	}
+	u, _ = url.Parse("/sum/cpu?rack=0&rack=1&match=all")
+	if f, _ = parseFilter(u); len(f) != 1 || !f[0].All {
+		t.Errorf("expected every value to be required, instead got %+v", f)
+	}
+	u, _ = url.Parse("/sum/cpu?region!=london&rack!in=1,2&rack!in=3")
+	f, _ = parseFilter(u)
+	expected = tagFilter{
+		{Key: "rack", Values: []string{"1", "2", "3"}, Negate: true},
+		{Key: "region", Values: []string{"london"}, Negate: true},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %+v, instead got %+v", expected, f)
+	}
+	u, _ = url.Parse("/sum/cpu?tag:from=london&tag:order!=1")
+	f, _ = parseFilter(u)
+	expected = tagFilter{
+		{Key: "from", Values: []string{"london"}},
+		{Key: "order", Values: []string{"1"}, Negate: true},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %+v, instead got %+v", expected, f)
+	}
+	u, _ = url.Parse("/sum/cpu?rack=0&match=some")
+	if _, err = parseFilter(u); err == nil {
+		t.Errorf("expected invalid match to be rejected")
+	}
+}
+
+func TestNegatedFilter(t *testing.T) {
+	index := dummyIndex1()
+	val, _ := index.GetTotalAggregate(&count{}, tagFilter{{Key: "rack", Values: []string{"0"}, Negate: true}})
+	if val != 9500 {
+		t.Errorf("expected count to be 9500, instead got %v", val)
+	}
+	val, _ = index.GetTotalAggregate(&count{}, tagFilter{
+		{Key: "rack", Values: []string{"0", "1", "2"}, Negate: true},
+		{Key: "rack", Values: []string{"2", "3"}},
+	})
+	if val != 500 {
+		t.Errorf("expected count to be 500, instead got %v", val)
+	}
+	//no point has a fleet, so none is in the excluded one
+	val, ok := index.GetTotalAggregate(&count{}, tagFilter{{Key: "fleet", Values: []string{"test"}, Negate: true}})
+	if !ok || val != 10000 {
+		t.Errorf("expected count to be 10000, instead got %v (found: %v)", val, ok)
+	}
+	if _, ok := index.GetTotalAggregate(&count{}, tagFilter{{Key: "fleet", Values: []string{"test"}}}); ok {
+		t.Errorf("expected unknown tag to be reported")
+	}
+	groups, _ := index.GetGroupByAggregate("rack", &count{}, tagFilter{{Key: "rack", Values: []string{"0"}, Negate: true}})
+	for _, g := range groups {
+		if expected := map[bool]float64{true: 0, false: 500}[g.Key == "0"]; g.Value != expected {
+			t.Errorf("expected %v points in rack %v, instead got %v", expected, g.Key, g.Value)
+		}
+	}
+}
+
+func TestPatternFilter(t *testing.T) {
+	m := make(Points, 0, 6)
+	for _, site := range []string{"uk-lon-1", "uk-lon-2", "uk-man-1", "fr-par-1", "fr-par-2", "de-ber-1"} {
+		m = append(m, Point{Tags: map[string][]string{"site": []string{site}}, Value: 1})
+	}
+	index := newInvertedIndex()
+	index.Index(m)
+	tests := []struct {
+		query string
+		count float64
+	}{
+		{"site=~^uk-", 3},
+		{"site=~-1$", 4},
+		{"site=uk-lon-*", 2},
+		{"site=uk-*&site=de-ber-1", 4},
+		{"site=~^uk-&site=~-1$&match=all", 2},
+		{"site!=~^uk-", 3},
+		{"site=~^es-", 0},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse("/count/power?" + test.query)
+		f, err := parseFilter(u)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		if count, _ := index.GetTotalAggregate(&count{}, f); count != test.count {
+			t.Errorf("%s: expected count %v, instead got %v", test.query, test.count, count)
+		}
+	}
+	u, _ := url.Parse("/count/power/by/site?site=fr-*")
+	f, _ := parseFilter(u)
+	groups, _ := index.GetGroupByAggregate("site", &count{}, f)
+	for _, g := range groups {
+		if expected := map[bool]float64{true: 1, false: 0}[g.Key[:3] == "fr-"]; g.Value != expected {
+			t.Errorf("expected %v points in site %v, instead got %v", expected, g.Key, g.Value)
+		}
+	}
+	u, _ = url.Parse("/count/power?site=~(")
+	if _, err := parseFilter(u); err == nil {
+		t.Errorf("expected invalid pattern to be rejected")
+	}
+}
+
+func TestComparisonFilter(t *testing.T) {
+	m := make(Points, 0, 6)
+	for _, capacity := range []string{"10", "50", "99.5", "200", "1e3", "n/a"} {
+		m = append(m, Point{Tags: map[string][]string{"capacity_kw": []string{capacity}}, Value: 1})
+	}
+	index := newInvertedIndex()
+	index.Index(m)
+	//the numeric views are rebuilt when the index is restored
+	b, _ := index.Marshal()
+	restored, err := unmarshalInvertedIndex(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		query string
+		count float64
+	}{
+		{"capacity_kw>=50", 4},
+		{"capacity_kw>50", 3},
+		{"capacity_kw<=50", 2},
+		{"capacity_kw<50", 1},
+		{"capacity_kw>=50&capacity_kw<200", 2},
+		{"capacity_kw>1000", 0},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse("/count/power?" + test.query)
+		f, err := parseFilter(u)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		for _, ii := range []invertedIndex{index, restored} {
+			if count, _ := ii.GetTotalAggregate(&count{}, f); count != test.count {
+				t.Errorf("%s: expected count %v, instead got %v", test.query, test.count, count)
+			}
+		}
+	}
+	u, _ := url.Parse("/count/power?capacity_kw<big")
+	if _, err := parseFilter(u); err == nil {
+		t.Errorf("expected invalid number to be rejected")
+	}
+}
+
+func TestUnionDifference(t *testing.T) {
+	l1 := leaf{Ids: []int{1, 3, 5}, Vals: []float64{1, 3, 5}}
+	l2 := leaf{Ids: []int{2, 3, 6}, Vals: []float64{2, 3, 6}}
+	expected := &leaf{Ids: []int{1, 2, 3, 5, 6}, Vals: []float64{1, 2, 3, 5, 6}}
+	if u := union(l1, l2); !reflect.DeepEqual(u, expected) {
+		t.Errorf("expected %+v, instead got %+v", expected, u)
+	}
+	if u := union(leaf{}, l2); !reflect.DeepEqual(u.Ids, l2.Ids) {
+		t.Errorf("expected %+v, instead got %+v", l2.Ids, u.Ids)
+	}
+	expected = &leaf{Ids: []int{1, 5}, Vals: []float64{1, 5}}
+	if d := difference(l1, l2); !reflect.DeepEqual(d, expected) {
+		t.Errorf("expected %+v, instead got %+v", expected, d)
+	}
+}
@@ -0,0 +1,173 @@
+package metrik
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//groupOptions filters, sorts and truncates the groups of group-by queries. By default they are
+//sorted by key.
+type groupOptions struct {
+	OmitEmpty bool //drop the groups without points rather than return them with a null value
+	Having    []groupCondition
+	ByValue   bool
+	Desc      bool
+	Limit     int //0 means no limit
+}
+
+//groupCondition keeps the groups whose value compares to Bound, eg. value>0.8
+type groupCondition struct {
+	Op    string
+	Bound float64
+}
+
+//operators are ordered so that the two-character ones are tried first
+var groupOperators = []string{">=", "<=", "!=", ">", "<", "="}
+
+func parseGroupCondition(s string) (groupCondition, error) {
+	var c groupCondition
+	if !strings.HasPrefix(s, "value") {
+		return c, errors.New("invalid having - " + s + " (expected a condition on the value, eg. value>0.8)")
+	}
+	rest := s[len("value"):]
+	for _, op := range groupOperators {
+		if strings.HasPrefix(rest, op) {
+			bound, err := strconv.ParseFloat(rest[len(op):], 64)
+			if err != nil {
+				return c, errors.New("invalid number in having - " + s)
+			}
+			return groupCondition{Op: op, Bound: bound}, nil
+		}
+	}
+	return c, errors.New("invalid having - " + s + " (use one of >=, <=, !=, >, < or =)")
+}
+
+//matches returns false for empty groups, as their value is null.
+func (c groupCondition) matches(g group) bool {
+	return g.Count > 0 && compare(g.Value, c.Op, c.Bound)
+}
+
+func parseGroupOptions(u *url.URL) (groupOptions, error) {
+	var (
+		o     groupOptions
+		query = u.Query()
+	)
+	switch query.Get("sort") {
+	case "", "key":
+	case "value":
+		o.ByValue = true
+	default:
+		return o, errors.New("invalid sort - use key or value")
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		o.Desc = true
+	default:
+		return o, errors.New("invalid order - use asc or desc")
+	}
+	switch query.Get("empty") {
+	case "", "null":
+	case "omit":
+		o.OmitEmpty = true
+	default:
+		return o, errors.New("invalid empty - use null or omit")
+	}
+	for _, having := range query["having"] {
+		c, err := parseGroupCondition(having)
+		if err != nil {
+			return o, err
+		}
+		o.Having = append(o.Having, c)
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return o, errors.New("invalid limit - " + limit)
+		}
+		o.Limit = n
+	}
+	return o, nil
+}
+
+//apply drops the empty groups if OmitEmpty is set and the groups that don't satisfy every
+//condition, sorts the others, in place, and returns the first Limit of them. Groups with the
+//same value are sorted by key, so the order is always the same. When sorting by value, empty
+//groups come last.
+func (o groupOptions) apply(groups []group) []group {
+	if o.OmitEmpty || len(o.Having) > 0 {
+		kept := groups[:0]
+	next:
+		for _, g := range groups {
+			if o.OmitEmpty && g.Count == 0 {
+				continue
+			}
+			for _, c := range o.Having {
+				if !c.matches(g) {
+					continue next
+				}
+			}
+			kept = append(kept, g)
+		}
+		groups = kept
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if o.ByValue && (a.Count == 0) != (b.Count == 0) {
+			return b.Count == 0
+		}
+		if o.Desc {
+			a, b = b, a
+		}
+		if o.ByValue && a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Key < b.Key
+	})
+	if o.Limit > 0 && len(groups) > o.Limit {
+		return groups[:o.Limit]
+	}
+	return groups
+}
+
+//handles requests of the form GET /top/:k/:aggregate/:metric/by/:tag, which is the group-by query
+//sorted by decreasing value and limited to k groups. ?sort= and ?order= can still be given, eg. to
+//get the bottom k groups with ?order=asc.
+func (s *Server) topHandlerWrapper(handler http.Handler) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path[len("/top/"):]
+		i := strings.IndexByte(path, '/')
+		if i == -1 {
+			//we should never reach this
+			panic("url was matched by regexp but clearly does not satisfy it")
+		}
+		k, err := strconv.Atoi(path[:i])
+		if err != nil || k < 1 {
+			s.addHeaders(w, 400)
+			w.Write(jsonError("invalid number of groups - " + path[:i]))
+			return
+		}
+		if !strings.Contains(path[i:], "/by/") {
+			s.addHeaders(w, 400)
+			w.Write(jsonError("top needs a group-by query, eg. /top/10/sum/cpu/by/rack"))
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("sort") == "" {
+			query.Set("sort", "value")
+		}
+		if query.Get("order") == "" {
+			query.Set("order", "desc")
+		}
+		query.Set("limit", strconv.Itoa(k))
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = path[i:]
+		r2.URL.RawPath = ""
+		r2.URL.RawQuery = query.Encode()
+		handler.ServeHTTP(w, r2)
+	}
+}
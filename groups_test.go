@@ -0,0 +1,83 @@
+package metrik
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestGroupOptions(t *testing.T) {
+	groups := func() []group {
+		return []group{{Key: "b", Value: 2, Count: 1}, {Key: "d", Value: 1, Count: 1}, {Key: "a", Value: 2, Count: 1}, {Key: "c", Value: 3, Count: 1}}
+	}
+	tests := []struct {
+		query string
+		keys  []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{"order=desc", []string{"d", "c", "b", "a"}},
+		{"sort=value", []string{"d", "a", "b", "c"}},
+		{"sort=value&order=desc&limit=3", []string{"c", "b", "a"}},
+		{"limit=10", []string{"a", "b", "c", "d"}},
+		{"having=value>1", []string{"a", "b", "c"}},
+		{"having=value>=2&having=value<3&sort=value", []string{"a", "b"}},
+		{"having=value=2", []string{"a", "b"}},
+		{"having=value!=2&order=desc", []string{"d", "c"}},
+		{"having=value>5", nil},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse("/sum/cpu/by/rack?" + test.query)
+		o, err := parseGroupOptions(u)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		var keys []string
+		for _, g := range o.apply(groups()) {
+			keys = append(keys, g.Key)
+		}
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%s: expected %v, instead got %v", test.query, test.keys, keys)
+		}
+	}
+	for _, query := range []string{"sort=name", "order=up", "limit=0", "limit=ten", "having=count>1", "having=value~1", "having=value>big"} {
+		u, _ := url.Parse("/sum/cpu/by/rack?" + query)
+		if _, err := parseGroupOptions(u); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestEmptyGroupOptions(t *testing.T) {
+	groups := func() []group {
+		return []group{{Key: "b", Value: 2, Count: 1}, {Key: "e", Count: 0}, {Key: "a", Value: 1, Count: 1}}
+	}
+	tests := []struct {
+		query string
+		keys  []string
+	}{
+		{"", []string{"a", "b", "e"}},
+		{"order=desc", []string{"e", "b", "a"}},
+		{"sort=value", []string{"a", "b", "e"}},
+		{"sort=value&order=desc", []string{"b", "a", "e"}},
+		{"empty=omit", []string{"a", "b"}},
+		{"empty=null&having=value<5", []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse("/sum/cpu/by/rack?" + test.query)
+		o, err := parseGroupOptions(u)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.query, err)
+		}
+		var keys []string
+		for _, g := range o.apply(groups()) {
+			keys = append(keys, g.Key)
+		}
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%s: expected %v, instead got %v", test.query, test.keys, keys)
+		}
+	}
+	u, _ := url.Parse("/sum/cpu/by/rack?empty=zero")
+	if _, err := parseGroupOptions(u); err == nil {
+		t.Errorf("empty=zero: expected an error")
+	}
+}
@@ -0,0 +1,130 @@
+package metrik
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	hllPrecision = 12                //number of bits of the hash used to pick a register
+	hllRegisters = 1 << hllPrecision //4096 registers, for a standard error of about 1.6%
+	//sketches are stored sparsely until that would take as much space as the dense registers
+	hllSparseMax = hllRegisters / 4
+)
+
+//type hyperLogLog is a sketch estimating the number of distinct strings added to it. Sketches
+//can be merged, which estimates the number of distinct strings in the union of their sets.
+//Small sketches are stored as a sorted list of non-zero registers (register<<8 | rank) rather
+//than the full array of registers, as most leaves only have a handful of distinct values.
+type hyperLogLog struct {
+	Sparse []uint32
+	Dense  []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+func hllHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	//fnv doesn't mix short strings well enough for the high bits to be uniform, so
+	//finish with the murmur3 finalizer
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *hyperLogLog) Add(s string) {
+	x := hllHash(s)
+	register := uint32(x >> (64 - hllPrecision))
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	h.set(register, rank)
+}
+
+//set raises the register to rank if it is lower.
+func (h *hyperLogLog) set(register uint32, rank uint8) {
+	if h.Dense != nil {
+		if h.Dense[register] < rank {
+			h.Dense[register] = rank
+		}
+		return
+	}
+	i := sort.Search(len(h.Sparse), func(i int) bool {
+		return h.Sparse[i]>>8 >= register
+	})
+	switch {
+	case i < len(h.Sparse) && h.Sparse[i]>>8 == register:
+		if uint8(h.Sparse[i]) < rank {
+			h.Sparse[i] = register<<8 | uint32(rank)
+		}
+	case len(h.Sparse) < hllSparseMax:
+		h.Sparse = append(h.Sparse, 0)
+		copy(h.Sparse[i+1:], h.Sparse[i:])
+		h.Sparse[i] = register<<8 | uint32(rank)
+	default:
+		h.toDense()
+		h.Dense[register] = rank
+	}
+}
+
+func (h *hyperLogLog) toDense() {
+	h.Dense = make([]uint8, hllRegisters)
+	for _, entry := range h.Sparse {
+		h.Dense[entry>>8] = uint8(entry)
+	}
+	h.Sparse = nil
+}
+
+//Merge adds the strings counted by o to the sketch.
+func (h *hyperLogLog) Merge(o *hyperLogLog) {
+	if o.Dense != nil {
+		if h.Dense == nil {
+			h.toDense()
+		}
+		for register, rank := range o.Dense {
+			if h.Dense[register] < rank {
+				h.Dense[register] = rank
+			}
+		}
+		return
+	}
+	for _, entry := range o.Sparse {
+		h.set(entry>>8, uint8(entry))
+	}
+}
+
+//Count estimates the number of distinct strings added to the sketch.
+func (h *hyperLogLog) Count() float64 {
+	var (
+		sum   float64
+		zeros int
+	)
+	if h.Dense != nil {
+		for _, rank := range h.Dense {
+			sum += math.Ldexp(1, -int(rank))
+			if rank == 0 {
+				zeros++
+			}
+		}
+	} else {
+		zeros = hllRegisters - len(h.Sparse)
+		sum = float64(zeros)
+		for _, entry := range h.Sparse {
+			sum += math.Ldexp(1, -int(uint8(entry)))
+		}
+	}
+	m := float64(hllRegisters)
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		//small range correction: linear counting
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
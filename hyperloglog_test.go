@@ -0,0 +1,41 @@
+package metrik
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.Add("asset-" + strconv.Itoa(i))
+			h.Add("asset-" + strconv.Itoa(i)) //duplicates don't count
+		}
+		if err := math.Abs(h.Count()-float64(n)) / math.Max(float64(n), 1); err > 0.05 {
+			t.Errorf("expected about %v distinct values, instead got %v", n, h.Count())
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	//the sketches overlap on half of their values, and one of them is dense
+	h1, h2 := newHyperLogLog(), newHyperLogLog()
+	for i := 0; i < 20000; i++ {
+		h1.Add(strconv.Itoa(i))
+	}
+	for i := 10000; i < 10500; i++ {
+		h2.Add(strconv.Itoa(i))
+	}
+	for i := 20000; i < 20500; i++ {
+		h2.Add(strconv.Itoa(i))
+	}
+	if h1.Dense == nil || h2.Dense != nil {
+		t.Fatalf("expected one dense and one sparse sketch")
+	}
+	h2.Merge(h1)
+	if err := math.Abs(h2.Count()-20500) / 20500; err > 0.05 {
+		t.Errorf("expected about 20500 distinct values, instead got %v", h2.Count())
+	}
+}
@@ -3,7 +3,12 @@ package metrik
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"math"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,25 +17,98 @@ type leaf struct {
 	Vals []float64
 }
 
-//type groups represents aggregated metric values, broken down by group-by tags.
+//type groups represents aggregated metric values, broken down by group-by tags. When grouping
+//by several tags, Keys has the value of each tag and Key joins them with commas. Count is the
+//number of points in the group: groups excluded by the filter have none, and their value is null
+//in JSON so that it isn't mistaken for a genuine zero.
 type group struct {
-	Key   string  `json:"key"`
-	Value float64 `json:"value"`
+	Key   string   `json:"key"`
+	Keys  []string `json:"keys,omitempty"`
+	Value float64  `json:"value"`
+	Count int      `json:"count"`
+}
+
+func (g group) MarshalJSON() ([]byte, error) {
+	type plainGroup group
+	if g.Count > 0 {
+		return json.Marshal(plainGroup(g))
+	}
+	return json.Marshal(struct {
+		Key   string   `json:"key"`
+		Keys  []string `json:"keys,omitempty"`
+		Value *float64 `json:"value"`
+		Count int      `json:"count"`
+	}{Key: g.Key, Keys: g.Keys})
 }
 
 type tagGroup map[string]*leaf
 
 //type invertedIndex is an immutable mapping from tag key-value pairs to arrays of points
 //that are tagged with those pairs. Because it's immutable we don't need any locking around it.
-type invertedIndex map[string]tagGroup
+//It also keeps the original points, so that they can be listed or exported: the id of a point
+//in the leaves is its position in Points. The numeric views aren't serialized, they are rebuilt
+//when the index is unmarshaled, and the sketches are only built when a distinct count needs them.
+type invertedIndex struct {
+	Tags     map[string]tagGroup
+	Points   Points
+	numeric  map[string]numericView
+	sketches *sketchCache
+}
+
+//type sketchCache holds, for every tag that distinct counts were requested for, the sketch of
+//its values among the points of each leaf of the index, so that distinct counts can be computed
+//by merging leaves rather than going through their points. It is shared by the copies of the index.
+type sketchCache struct {
+	sync.Mutex
+	byTag map[string]map[*leaf]*hyperLogLog
+}
+
+func newSketchCache() *sketchCache {
+	return &sketchCache{byTag: make(map[string]map[*leaf]*hyperLogLog)}
+}
+
+type numericValue struct {
+	Value float64
+	Key   string
+}
+
+//type numericView lists the values of a tag key that are numbers, sorted in increasing order, so
+//that numeric comparisons don't need to go through every leaf.
+type numericView []numericValue
+
+//compare returns the values v for which "v op bound" is true.
+func (v numericView) compare(op string, bound float64) numericView {
+	switch op {
+	case "<":
+		return v[:sort.Search(len(v), func(i int) bool { return v[i].Value >= bound })]
+	case "<=":
+		return v[:sort.Search(len(v), func(i int) bool { return v[i].Value > bound })]
+	case ">":
+		return v[sort.Search(len(v), func(i int) bool { return v[i].Value > bound }):]
+	case ">=":
+		return v[sort.Search(len(v), func(i int) bool { return v[i].Value >= bound }):]
+	}
+	return nil
+}
 
 type timeSeriesItem struct {
 	T     time.Time
 	Index invertedIndex
 }
 
+//type timeSeries is a bounded history of index snapshots, sorted by time. Its capacity is
+//the maximum number of snapshots it keeps: once full, the oldest snapshot is dropped to make
+//room for new ones.
 type timeSeries []*timeSeriesItem
 
+func newTimeSeries(size int) *timeSeries {
+	if size < 1 {
+		size = 1
+	}
+	t := make(timeSeries, 0, size)
+	return &t
+}
+
 func (t timeSeries) Latest() *timeSeriesItem {
 
 	if len(t) == 0 {
@@ -47,63 +125,148 @@ func (t timeSeries) GreaterThan(start time.Time) []*timeSeriesItem {
 	return t[i:]
 }
 
-func (t timeSeries) Insert(timestamp time.Time, index invertedIndex) {
+//At returns the most recent snapshot taken at or before timestamp, or nil if there isn't one.
+func (t timeSeries) At(timestamp time.Time) *timeSeriesItem {
 	i := sort.Search(len(t), func(i int) bool {
 		return t[i].T.After(timestamp)
 	})
-	
-	switch {
-		case i == len(t) && len(t) < cap(t):
-			//append
-			t = append(t, &timeSeriesItem{timestamp, index})
-		case i == len(t) && len(t) == cap(t):
-			//truncate and append
-			t = append(t[1:], &timeSeriesItem{timestamp, index})
-		case i == 0 && len(t) < cap(t):
-			//prepend
-			t = append([]*timeSeriesItem{&timeSeriesItem{timestamp, index}}, t...)
-		case i == 0 && len(t) == cap(t):
-			//can't prepend since the buffer is full 
+	if i == 0 {
+		return nil
+	}
+	return t[i-1]
+}
+
+//Between returns a copy of the snapshots taken in the closed interval [start, end]. A zero
+//start or end leaves the interval open on that side.
+func (t timeSeries) Between(start, end time.Time) []*timeSeriesItem {
+	i := 0
+	if !start.IsZero() {
+		i = sort.Search(len(t), func(i int) bool {
+			return !t[i].T.Before(start)
+		})
+	}
+	j := len(t)
+	if !end.IsZero() {
+		j = sort.Search(len(t), func(j int) bool {
+			return t[j].T.After(end)
+		})
+	}
+	if j <= i {
+		return nil
+	}
+	ret := make([]*timeSeriesItem, j-i)
+	copy(ret, t[i:j])
+	return ret
+}
+
+func (t *timeSeries) Insert(timestamp time.Time, index invertedIndex) {
+	s := *t
+	i := sort.Search(len(s), func(i int) bool {
+		return s[i].T.After(timestamp)
+	})
+	item := &timeSeriesItem{timestamp, index}
+
+	if len(s) == cap(s) {
+		if i == 0 {
+			//older than everything we have and the buffer is full:
 			//ignore the request
 			return
-		default:
-			//somewhere in the middle
-			if len(t) < cap(t) {
-				t = append(t[:i], append([]*timeSeriesItem{&timeSeriesItem{timestamp, index}}, t[i+1:]...)...)
-			} else {
-				//truncate and insert
-				t = append(t[1:i], append([]*timeSeriesItem{&timeSeriesItem{timestamp, index}}, t[i+1:]...)...)
-			}
-	}		
+		}
+		//drop the oldest snapshot to make room, without growing the buffer
+		copy(s[:i-1], s[1:i])
+		s[i-1] = item
+		return
+	}
+
+	s = append(s, nil)
+	copy(s[i+1:], s[i:])
+	s[i] = item
+	*t = s
 }
 
 //fast path in case the timestamp is left to wall time
-func (t timeSeries) Append(index invertedIndex) {
-	t = append(t, &timeSeriesItem{time.Now(), index})
+func (t *timeSeries) Append(index invertedIndex) {
+	t.Insert(time.Now(), index)
 }
 
 func newInvertedIndex() invertedIndex {
-	ii := make(invertedIndex)
+	ii := invertedIndex{Tags: make(map[string]tagGroup)}
 	return ii
 }
 
-func (ii invertedIndex) Index(points Points) {
+func (ii *invertedIndex) Index(points Points) {
+	ii.Points = points
 	for i := range points {
 		ii.indexPoint(points[i], i)
 	}
+	ii.buildNumericViews()
+	ii.sketches = newSketchCache()
+}
+
+func (ii *invertedIndex) buildNumericViews() {
+	ii.numeric = make(map[string]numericView)
+	for tag, tg := range ii.Tags {
+		var view numericView
+		for key := range tg {
+			if v, err := strconv.ParseFloat(key, 64); err == nil && !math.IsNaN(v) {
+				view = append(view, numericValue{Value: v, Key: key})
+			}
+		}
+		sort.Slice(view, func(i, j int) bool {
+			return view[i].Value < view[j].Value
+		})
+		ii.numeric[tag] = view
+	}
+}
+
+//leafSketches returns the sketches of the values of the tag in every leaf, building them the
+//first time they are needed.
+func (ii invertedIndex) leafSketches(tag string) map[*leaf]*hyperLogLog {
+	ii.sketches.Lock()
+	defer ii.sketches.Unlock()
+	if sketches, ok := ii.sketches.byTag[tag]; ok {
+		return sketches
+	}
+	sketches := make(map[*leaf]*hyperLogLog)
+	for _, point := range ii.Points {
+		values := point.Tags[tag]
+		if len(values) == 0 {
+			continue
+		}
+		for otherTag, otherValues := range point.Tags {
+			for _, otherVal := range otherValues {
+				l := ii.Tags[otherTag][otherVal]
+				sketch, ok := sketches[l]
+				if !ok {
+					sketch = newHyperLogLog()
+					sketches[l] = sketch
+				}
+				for _, val := range values {
+					sketch.Add(val)
+				}
+			}
+		}
+	}
+	ii.sketches.byTag[tag] = sketches
+	return sketches
 }
 
-func (ii invertedIndex) indexPoint(point Point, id int) {
+func (ii *invertedIndex) indexPoint(point Point, id int) {
 	for tag, values := range point.Tags {
-		if tagMap, ok := ii[tag]; ok {
+		if tagMap, ok := ii.Tags[tag]; ok {
 			for _, val := range values {
 				if tagVal, ok2 := tagMap[val]; ok2 {
+					if tagVal.Ids[len(tagVal.Ids)-1] == id {
+						//repeated value, eg. {"rack": ["0", "0"]}: the
+						//point is already in the leaf
+						continue
+					}
 					//append to existing leaf
 					tagVal.Ids = append(tagVal.Ids, id)
 					tagVal.Vals = append(tagVal.Vals, point.Value)
 				} else {
 					//new leaf
-					ii[tag][val] = &leaf{
+					ii.Tags[tag][val] = &leaf{
 						Ids:  []int{id},
 						Vals: []float64{point.Value},
 					}
@@ -111,9 +274,13 @@ func (ii invertedIndex) indexPoint(point Point, id int) {
 			}
 		} else {
 			//new tag key
-			ii[tag] = make(tagGroup)
+			ii.Tags[tag] = make(tagGroup)
 			for _, val := range values {
-				ii[tag][val] = &leaf{
+				if _, ok2 := ii.Tags[tag][val]; ok2 {
+					//repeated value
+					continue
+				}
+				ii.Tags[tag][val] = &leaf{
 					Ids:  []int{id},
 					Vals: []float64{point.Value},
 				}
@@ -123,11 +290,11 @@ func (ii invertedIndex) indexPoint(point Point, id int) {
 }
 
 func (ii invertedIndex) GetTagGroup(t Tag) (tagGroup, bool) {
-	group, ok := ii[t.Name]
+	group, ok := ii.Tags[t.Name]
 	return group, ok
 }
 
-func (ii invertedIndex) GetGroupByAggregate(tag string, a Aggregator, t Tags) ([]group, bool) {
+func (ii invertedIndex) GetGroupByAggregate(tag string, a Aggregator, f tagFilter) ([]group, bool) {
 	var (
 		tg             tagGroup
 		ok             bool
@@ -135,11 +302,11 @@ func (ii invertedIndex) GetGroupByAggregate(tag string, a Aggregator, t Tags) ([
 		filter         *leaf
 		filteredValues *leaf
 	)
-	if tg, ok = ii[tag]; !ok {
+	if tg, ok = ii.Tags[tag]; !ok {
 		return nil, false
 	}
-	if t != nil && len(t) > 0 {
-		filter, ok = ii.filter(t)
+	if len(f) > 0 {
+		filter, ok = ii.filter(f)
 		if !ok {
 			return nil, false
 		}
@@ -148,14 +315,13 @@ func (ii invertedIndex) GetGroupByAggregate(tag string, a Aggregator, t Tags) ([
 
 	ret = make([]group, 0, len(tg))
 	for key, values := range tg {
-		if filterVals, ok := t[tag]; ok && !isIn(filterVals, key) {
+		if !f.admits(tag, key) {
 			//short-circuit if we are filtering by the group-by
 			//tag and the filter value doesn't match the current
 			//leaf tag value. Eg. group by rack where rack = 0
 			//only matches one leaf.
 			ret = append(ret, group{
-				Key:   key,
-				Value: 0,
+				Key: key,
 			})
 			continue
 		}
@@ -164,14 +330,91 @@ func (ii invertedIndex) GetGroupByAggregate(tag string, a Aggregator, t Tags) ([
 		} else {
 			filteredValues = intersect(*filter, *values)
 		}
+		if len(filteredValues.Ids) == 0 {
+			ret = append(ret, group{
+				Key: key,
+			})
+			continue
+		}
 		ret = append(ret, group{
 			Key:   key,
-			Value: a.Apply(filteredValues.Vals),
+			Value: ii.apply(a, filteredValues),
+			Count: len(filteredValues.Ids),
 		})
 	}
 	return ret, true
 }
 
+//GetCompositeGroupByAggregate groups by the combinations of values of several tags, eg. region
+//and asset type, by intersecting the leaves of each tag. Unlike GetGroupByAggregate, it only
+//returns the combinations that have points, as there can be a great many of the others.
+func (ii invertedIndex) GetCompositeGroupByAggregate(tags []string, a Aggregator, f tagFilter) ([]group, bool) {
+	for _, tag := range tags {
+		if _, ok := ii.Tags[tag]; !ok {
+			return nil, false
+		}
+	}
+	var filter *leaf
+	if len(f) > 0 {
+		var ok bool
+		if filter, ok = ii.filter(f); !ok {
+			return nil, false
+		}
+	}
+	ret := make([]group, 0)
+	ii.groupCombinations(tags, make([]string, 0, len(tags)), filter, a, f, &ret)
+	return ret, true
+}
+
+//groupCombinations appends a group for every combination of values of the remaining tags that
+//has points among those of l (every point, if l is nil).
+func (ii invertedIndex) groupCombinations(tags []string, keys []string, l *leaf, a Aggregator, f tagFilter, ret *[]group) {
+	if len(tags) == 0 {
+		*ret = append(*ret, group{
+			Key:   strings.Join(keys, ","),
+			Keys:  append([]string{}, keys...),
+			Value: ii.apply(a, l),
+			Count: len(l.Ids),
+		})
+		return
+	}
+	for key, values := range ii.Tags[tags[0]] {
+		if !f.admits(tags[0], key) {
+			continue
+		}
+		matched := values
+		if l != nil {
+			matched = intersect(*l, *values)
+		}
+		if len(matched.Ids) == 0 {
+			continue
+		}
+		ii.groupCombinations(tags[1:], append(keys, key), matched, a, f, ret)
+	}
+}
+
+//groupBy groups by a single tag, or by the combinations of values of several tags.
+func (ii invertedIndex) groupBy(tags []string, a Aggregator, f tagFilter) ([]group, bool) {
+	if len(tags) == 1 {
+		return ii.GetGroupByAggregate(tags[0], a, f)
+	}
+	return ii.GetCompositeGroupByAggregate(tags, a, f)
+}
+
+//apply the aggregator to the points of the leaf, passing the points themselves to
+//aggregators that need them.
+func (ii invertedIndex) apply(a Aggregator, l *leaf) float64 {
+	pa, ok := a.(PointAggregator)
+	if !ok {
+		return a.Apply(l.Vals)
+	}
+	points := make(Points, len(l.Ids))
+	for i, id := range l.Ids {
+		points[i] = ii.Points[id]
+	}
+	return pa.ApplyPoints(points)
+}
+
 func isIn(slice []string, search string) bool {
 	for _, s := range slice {
 		if s == search {
@@ -183,42 +426,111 @@ func isIn(slice []string, search string) bool {
 
 //get total aggregate, optionally filtered by tags. the bool return functions as 'ok',
 //as in 'ok, we found the tags in the filter'
-func (ii invertedIndex) GetTotalAggregate(a Aggregator, t Tags) (float64, bool) {
-	var valList [][]float64
-
-	//no filter
-	if t == nil || len(t) == 0 {
-		for _, branch := range ii {
-			for _, tagLeaf := range branch {
-				valList = append(valList, tagLeaf.Vals) //slices are passed by reference so this doesn't actually create a copy of the data...right?
-			}
+func (ii invertedIndex) GetTotalAggregate(a Aggregator, f tagFilter) (float64, bool) {
+	//no filter: aggregate the point table, which includes the points without tags
+	if len(f) == 0 {
+		if pa, ok := a.(PointAggregator); ok {
+			return pa.ApplyPoints(ii.Points), true
 		}
-		return a.ApplyMany(valList), true
+		vals := make([]float64, len(ii.Points))
+		for i := range ii.Points {
+			vals[i] = ii.Points[i].Value
+		}
+		return a.Apply(vals), true
 	}
 
-	if filtered, ok := ii.filter(t); ok {
-		return a.Apply(filtered.Vals), true
+	if filtered, ok := ii.filter(f); ok {
+		return ii.apply(a, filtered), true
 	}
 
 	return 0, false
 
 }
 
-func (ii invertedIndex) filter(t Tags) (*leaf, bool) {
+//GetDistinctCount estimates the number of distinct values of the tag among the points matching
+//the filter. Without a filter the count is exact, and filtering by a single key-value pair merges
+//the sketches of the leaf instead of going through the points. The bool return functions as 'ok',
+//as in 'ok, we found the tag and the tags in the filter'
+func (ii invertedIndex) GetDistinctCount(tag string, f tagFilter) (float64, bool) {
+	tg, ok := ii.Tags[tag]
+	if !ok {
+		return 0, false
+	}
+	if len(f) == 0 {
+		return float64(len(tg)), true
+	}
+	if sketch, ok := ii.sketch(tag, f); ok {
+		return math.Round(sketch.Count()), true
+	}
+
+	filtered, ok := ii.filter(f)
+	if !ok {
+		return 0, false
+	}
+	sketch := newHyperLogLog()
+	for _, id := range filtered.Ids {
+		for _, val := range ii.Points[id].Tags[tag] {
+			sketch.Add(val)
+		}
+	}
+	return math.Round(sketch.Count()), true
+}
+
+//sketch returns the sketch of the values of the tag among the points matching the filter, if
+//it can be had by merging the sketches of the leaves rather than going through the points: that
+//is, if the filter selects the points tagged with any of the values (or patterns) of a single key.
+func (ii invertedIndex) sketch(tag string, f tagFilter) (*hyperLogLog, bool) {
+	if len(f) != 1 || f[0].Negate || (f[0].All && f[0].terms() > 1) {
+		return nil, false
+	}
+	if _, ok := ii.Tags[f[0].Key]; !ok || ii.sketches == nil {
+		return nil, false
+	}
+	sketches := ii.leafSketches(tag)
+	sketch := newHyperLogLog()
+	for _, l := range ii.leaves(f[0]) {
+		if sketches[l] != nil {
+			sketch.Merge(sketches[l])
+		}
+	}
+	return sketch, true
+}
+
+//get the points, optionally filtered by tags. the bool return functions as 'ok',
+//as in 'ok, we found the tags in the filter'
+func (ii invertedIndex) GetPoints(f tagFilter) (Points, bool) {
+	if len(f) == 0 {
+		return ii.Points, true
+	}
+
+	filtered, ok := ii.filter(f)
+	if !ok {
+		return nil, false
+	}
+	ret := make(Points, len(filtered.Ids))
+	for i, id := range filtered.Ids {
+		ret[i] = ii.Points[id]
+	}
+	return ret, true
+}
+
+//filter returns the points matching every predicate of the filter, or false if no point has
+//one of the tag keys.
+func (ii invertedIndex) filter(f tagFilter) (*leaf, bool) {
 	var intersection *leaf
-	for tagKey, tagValues := range t {
-		if leaves, ok := ii[tagKey]; ok {
-			for _, val := range tagValues {
-				if l, ok2 := leaves[val]; ok2 && intersection == nil {
-					//initialize intersection
-					intersection = l
-				} else if ok2 && intersection != nil {
-					intersection = intersect(*intersection, *l)
-				}
-			}
-		} else {
+	for _, p := range f {
+		l, ok := ii.match(p)
+		if !ok {
 			return nil, false
 		}
+		if intersection == nil {
+			intersection = l
+		} else {
+			intersection = intersect(*intersection, *l)
+		}
+	}
+	if intersection == nil {
+		intersection = &leaf{}
 	}
 	return intersection, true
 }
@@ -241,16 +553,18 @@ func intersect(l1, l2 leaf) *leaf {
 	}
 	ret.Ids = make([]int, 0, capacity)
 	ret.Vals = make([]float64, 0, capacity)
-	for i, s := range l1.Ids {
-		for _, t := range l2.Ids {
-			if t > s {
-				break
-			}
-			if s == t {
-				ret.Ids = append(ret.Ids, s)
-				ret.Vals = append(ret.Vals, l1.Vals[i]) //doesn't matter if we use l1.Vals or l2.Vals
-				break
-			}
+	var i, j int
+	for i < len(l1.Ids) && j < len(l2.Ids) {
+		switch {
+		case l1.Ids[i] < l2.Ids[j]:
+			i++
+		case l2.Ids[j] < l1.Ids[i]:
+			j++
+		default:
+			ret.Ids = append(ret.Ids, l1.Ids[i])
+			ret.Vals = append(ret.Vals, l1.Vals[i]) //doesn't matter if we use l1.Vals or l2.Vals
+			i++
+			j++
 		}
 	}
 	return &ret
@@ -266,11 +580,34 @@ func (ii invertedIndex) Marshal() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+func (t *timeSeriesItem) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(t)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalTimeSeriesItem(b []byte) (*timeSeriesItem, error) {
+	var (
+		t timeSeriesItem
+	)
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	err := dec.Decode(&t)
+	t.Index.buildNumericViews()
+	t.Index.sketches = newSketchCache()
+	return &t, err
+}
+
 func unmarshalInvertedIndex(b []byte) (invertedIndex, error) {
 	var (
 		ii invertedIndex
 	)
 	dec := gob.NewDecoder(bytes.NewBuffer(b))
 	err := dec.Decode(&ii)
+	ii.buildNumericViews()
+	ii.sketches = newSketchCache()
 	return ii, err
 }
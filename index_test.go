@@ -1,8 +1,10 @@
 package metrik
 
 import (
+	"encoding/json"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func dummyIndex1() *invertedIndex {
@@ -36,16 +38,138 @@ func TestTotal(t *testing.T) {
 
 func TestTotalFiltered(t *testing.T) {
 	index := dummyIndex1()
-	val, _ := index.GetTotalAggregate(&count{}, map[string][]string{"rack": []string{"0"}})
+	val, _ := index.GetTotalAggregate(&count{}, matchTags(map[string][]string{"rack": []string{"0"}}))
 	if val != 500 {
 		t.Errorf("expected count to be 500, instead got %v", val)
 	}
-	val, _ = index.GetTotalAggregate(&count{}, map[string][]string{"rack": []string{"0", "1"}})
+	//repeated values of a key are or-ed
+	val, _ = index.GetTotalAggregate(&count{}, matchTags(map[string][]string{"rack": []string{"0", "1"}}))
+	if val != 1000 {
+		t.Errorf("expected count to be 1000, instead got %v", val)
+	}
+	//unless every value must match
+	val, _ = index.GetTotalAggregate(&count{}, tagFilter{{Key: "rack", Values: []string{"0", "1"}, All: true}})
 	if val != 0 {
 		t.Errorf("expected count to be 0, instead got %v", val)
 	}
 }
 
+func TestTotalUntagged(t *testing.T) {
+	index := newInvertedIndex()
+	index.Index(Points{
+		{Tags: map[string][]string{"rack": []string{"0"}}, Value: 1},
+		{Value: 2},
+	})
+	val, _ := index.GetTotalAggregate(&sum{}, nil)
+	if val != 3 {
+		t.Errorf("expected sum to include untagged point and be 3, instead got %v", val)
+	}
+	val, ok := index.GetTotalAggregate(&sum{}, matchTags(map[string][]string{"rack": []string{"1"}}))
+	if !ok || val != 0 {
+		t.Errorf("expected sum of unknown tag value to be 0, instead got %v", val)
+	}
+}
+
+//points with several tags, or several values for a tag, must only be counted once
+func TestTotalMultiTag(t *testing.T) {
+	index := newInvertedIndex()
+	index.Index(Points{
+		{Tags: map[string][]string{"rack": []string{"0"}, "region": []string{"uk"}}, Value: 1},
+		{Tags: map[string][]string{"rack": []string{"0", "1"}, "region": []string{"uk"}}, Value: 2},
+		{Tags: map[string][]string{"rack": []string{"1", "1"}, "region": []string{"fr", "uk"}}, Value: 4},
+	})
+	tests := []struct {
+		filter Tags
+		count  float64
+		sum    float64
+	}{
+		{nil, 3, 7},
+		{map[string][]string{"rack": []string{"0"}}, 2, 3},
+		{map[string][]string{"rack": []string{"1"}}, 2, 6},
+		{map[string][]string{"region": []string{"uk"}}, 3, 7},
+		{map[string][]string{"rack": []string{"1"}, "region": []string{"uk"}}, 2, 6},
+		{map[string][]string{"rack": []string{"1"}, "region": []string{"fr"}}, 1, 4},
+		{map[string][]string{"rack": []string{"0", "1"}}, 3, 7},
+	}
+	for _, test := range tests {
+		if count, _ := index.GetTotalAggregate(count{}, matchTags(test.filter)); count != test.count {
+			t.Errorf("%v: expected count %v, instead got %v", test.filter, test.count, count)
+		}
+		if sum, _ := index.GetTotalAggregate(sum{}, matchTags(test.filter)); sum != test.sum {
+			t.Errorf("%v: expected sum %v, instead got %v", test.filter, test.sum, sum)
+		}
+	}
+	groups, _ := index.GetGroupByAggregate("rack", count{}, nil)
+	for _, g := range groups {
+		if g.Value != 2 {
+			t.Errorf("expected 2 points in rack %v, instead got %v", g.Key, g.Value)
+		}
+	}
+}
+
+func TestGetPoints(t *testing.T) {
+	index := dummyIndex1()
+	points, _ := index.GetPoints(nil)
+	if len(points) != 10000 {
+		t.Errorf("expected 10000 points, instead got %v", len(points))
+	}
+	points, _ = index.GetPoints(matchTags(map[string][]string{"rack": []string{"3"}}))
+	if len(points) != 500 {
+		t.Fatalf("expected 500 points, instead got %v", len(points))
+	}
+	for _, point := range points {
+		if point.Tags["rack"][0] != "3" {
+			t.Errorf("expected point in rack 3, instead got %v", point.Tags)
+		}
+	}
+	if _, ok := index.GetPoints(matchTags(map[string][]string{"region": []string{"uk"}})); ok {
+		t.Errorf("expected unknown tag to be reported")
+	}
+}
+
+func TestDistinctCount(t *testing.T) {
+	m := make(Points, 10000)
+	for i := range m {
+		m[i] = Point{
+			Tags: map[string][]string{
+				"asset":  []string{strconv.Itoa(i)},
+				"region": []string{strconv.Itoa(i % 4)},
+				"rack":   []string{strconv.Itoa(i % 20)},
+			},
+			Value: 1.0,
+		}
+	}
+	index := newInvertedIndex()
+	index.Index(m)
+	if n, _ := index.GetDistinctCount("asset", nil); n != 10000 {
+		t.Errorf("expected 10000 assets, instead got %v", n)
+	}
+	if len(index.sketches.byTag) != 0 {
+		t.Errorf("expected sketches to be built only when needed")
+	}
+	if n, _ := index.GetDistinctCount("rack", matchTags(map[string][]string{"region": []string{"1"}})); n != 5 {
+		t.Errorf("expected 5 racks in region 1, instead got %v", n)
+	}
+	n, _ := index.GetDistinctCount("asset", matchTags(map[string][]string{"region": []string{"1"}}))
+	if n < 2400 || n > 2600 {
+		t.Errorf("expected about 2500 assets in region 1, instead got %v", n)
+	}
+	//not a single key-value pair, so counted from the points
+	n, _ = index.GetDistinctCount("asset", matchTags(map[string][]string{"region": []string{"1"}, "rack": []string{"1"}}))
+	if n < 480 || n > 520 {
+		t.Errorf("expected about 500 assets in region 1 and rack 1, instead got %v", n)
+	}
+	if n, _ := index.GetDistinctCount("asset", matchTags(map[string][]string{"region": []string{"5"}})); n != 0 {
+		t.Errorf("expected no assets in region 5, instead got %v", n)
+	}
+	if len(index.sketches.byTag) != 2 {
+		t.Errorf("expected sketches of the rack and asset tags only, instead got %v", len(index.sketches.byTag))
+	}
+	if _, ok := index.GetDistinctCount("site", nil); ok {
+		t.Errorf("expected unknown tag to be reported")
+	}
+}
+
 func TestGroupBy(t *testing.T) {
 	index := dummyIndex1()
 	val, _ := index.GetGroupByAggregate("rack", &sum{}, nil)
@@ -61,7 +185,7 @@ func TestGroupBy(t *testing.T) {
 
 func TestGroupByFiltered(t *testing.T) {
 	index := dummyIndex1()
-	val, _ := index.GetGroupByAggregate("rack", &sum{}, map[string][]string{"rack": []string{"0"}})
+	val, _ := index.GetGroupByAggregate("rack", &sum{}, matchTags(map[string][]string{"rack": []string{"0"}}))
 	if len(val) != 20 {
 		t.Errorf("expected 20 groups, instead got %v", len(val))
 	}
@@ -75,6 +199,94 @@ func TestGroupByFiltered(t *testing.T) {
 
 }
 
+func TestGroupByEmpty(t *testing.T) {
+	index := dummyIndex1()
+	groups, _ := index.GetGroupByAggregate("rack", &avg{}, matchTags(map[string][]string{"rack": []string{"0"}}))
+	for _, g := range groups {
+		if g.Key == "0" && (g.Count != 500 || g.Value != 1) {
+			t.Errorf("expected 500 points averaging 1, instead got %+v", g)
+		} else if g.Key != "0" && g.Count != 0 {
+			t.Errorf("expected empty group, instead got %+v", g)
+		}
+	}
+	b, err := json.Marshal([]group{{Key: "0", Value: 0, Count: 3}, {Key: "1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := `[{"key":"0","value":0,"count":3},{"key":"1","value":null,"count":0}]`; string(b) != expected {
+		t.Errorf("expected %s, instead got %s", expected, b)
+	}
+	if val := (avg{}).ApplyMany([][]float64{{}, nil}); val != 0 {
+		t.Errorf("expected average of no values to be 0, instead got %v", val)
+	}
+}
+
+func TestCompositeGroupBy(t *testing.T) {
+	m := make(Points, 1200)
+	for i := range m {
+		m[i] = Point{
+			Tags: map[string][]string{
+				"region": []string{strconv.Itoa(i % 4)},
+				"type":   []string{strconv.Itoa(i % 6)},
+			},
+			Value: 1.0,
+		}
+	}
+	index := newInvertedIndex()
+	index.Index(m)
+	//i % 4 and i % 6 have the same parity, so only half of the 24 combinations have points
+	groups, _ := index.GetCompositeGroupByAggregate([]string{"region", "type"}, &count{}, nil)
+	if len(groups) != 12 {
+		t.Fatalf("expected 12 groups, instead got %v", len(groups))
+	}
+	for _, g := range groups {
+		if len(g.Keys) != 2 || g.Key != g.Keys[0]+","+g.Keys[1] || g.Value != 100 {
+			t.Errorf("unexpected group %+v", g)
+		}
+	}
+	groups, _ = index.GetCompositeGroupByAggregate([]string{"region", "type"}, &count{}, matchTags(map[string][]string{"region": []string{"1"}}))
+	if len(groups) != 3 {
+		t.Errorf("expected 3 groups, instead got %+v", groups)
+	}
+	if _, ok := index.GetCompositeGroupByAggregate([]string{"region", "site"}, &count{}, nil); ok {
+		t.Errorf("expected unknown tag to be reported")
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+	series := newTimeSeries(3)
+	t0 := time.Date(2016, 10, 17, 10, 0, 0, 0, time.UTC)
+	for _, i := range []int{1, 3, 0, 2} {
+		series.Insert(t0.Add(time.Duration(i)*time.Minute), newInvertedIndex())
+	}
+	//the oldest snapshot should have been dropped
+	if len(*series) != 3 || cap(*series) != 3 {
+		t.Fatalf("expected 3 snapshots in a buffer of 3, instead got %v in %v", len(*series), cap(*series))
+	}
+	for i, item := range *series {
+		if expected := t0.Add(time.Duration(i+1) * time.Minute); !item.T.Equal(expected) {
+			t.Errorf("expected snapshot %v to be at %v, instead got %v", i, expected, item.T)
+		}
+	}
+	//full buffer: snapshots older than everything are ignored
+	series.Insert(t0, newInvertedIndex())
+	if !series.Latest().T.Equal(t0.Add(3*time.Minute)) || !(*series)[0].T.Equal(t0.Add(time.Minute)) {
+		t.Errorf("expected snapshot older than the buffer to be ignored")
+	}
+	if item := series.At(t0.Add(150 * time.Second)); item == nil || !item.T.Equal(t0.Add(2*time.Minute)) {
+		t.Errorf("expected snapshot at 10:02:30 to be the one taken at 10:02, instead got %v", item)
+	}
+	if item := series.At(t0); item != nil {
+		t.Errorf("expected no snapshot at 10:00, instead got %v", item.T)
+	}
+	if items := series.Between(t0.Add(2*time.Minute), time.Time{}); len(items) != 2 {
+		t.Errorf("expected 2 snapshots from 10:02, instead got %v", len(items))
+	}
+	if items := series.Between(t0, t0.Add(time.Minute)); len(items) != 1 {
+		t.Errorf("expected 1 snapshot until 10:01, instead got %v", len(items))
+	}
+}
+
 func BenchmarkTotal(b *testing.B) {
 	b.StopTimer()
 	index := dummyIndex1()
@@ -87,7 +299,7 @@ func BenchmarkTotal(b *testing.B) {
 func BenchmarkTotalFiltered(b *testing.B) {
 	b.StopTimer()
 	index := dummyIndex1()
-	filter := map[string][]string{"rack": []string{"0"}}
+	filter := matchTags(map[string][]string{"rack": []string{"0"}})
 	b.StartTimer()
 	for n := 0; n < b.N; n++ {
 		index.GetTotalAggregate(&avg{}, filter)
@@ -106,9 +318,26 @@ func BenchmarkGroupBy(b *testing.B) {
 func BenchmarkGroupByFiltered(b *testing.B) {
 	b.StopTimer()
 	index := dummyIndex1()
-	filter := map[string][]string{"rack": []string{"0"}}
+	filter := matchTags(map[string][]string{"rack": []string{"0"}})
 	b.StartTimer()
 	for n := 0; n < b.N; n++ {
 		index.GetGroupByAggregate("rack", &avg{}, filter)
 	}
 }
+
+func BenchmarkCompositeGroupBy(b *testing.B) {
+	b.StopTimer()
+	m := make(Points, 100000)
+	for i := range m {
+		m[i] = Point{
+			Tags:  map[string][]string{"region": []string{strconv.Itoa(i % 10)}, "type": []string{strconv.Itoa(i / 10 % 10)}},
+			Value: 1.0,
+		}
+	}
+	index := newInvertedIndex()
+	index.Index(m)
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		index.GetCompositeGroupByAggregate([]string{"region", "type"}, &avg{}, nil)
+	}
+}
@@ -0,0 +1,76 @@
+package metrik
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//maxIngestBytes is the largest request body accepted by the ingestion routes.
+const maxIngestBytes = 32 << 20
+
+const serviceUnavailable = `
+{"error": "updaters not started"}
+`
+
+//errNotStarted is returned by publish if Start() hasn't been called.
+var errNotStarted = errors.New("updaters not started")
+
+//publish feeds the points into the pipeline of the metric, as if they had been sent by its updater.
+//The points replace the current snapshot of the metric.
+func (s *Server) publish(ctx context.Context, metric string, points Points) error {
+	ch, ok := s._updateChans[metric]
+	if !ok {
+		return errNotStarted
+	}
+	select {
+	case ch <- points:
+		return nil
+	case <-s._done:
+		return errNotStarted
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//handles requests of the form POST /ingest/:metric with a JSON array of points as the body,
+//eg. [{"tags": {"rack": ["1"]}, "value": 0.5}].
+func (s *Server) ingestHandler(w http.ResponseWriter, r *http.Request) {
+	metricName := strings.Trim(r.URL.Path[len("/ingest/"):], "/")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.addHeaders(w, 405)
+		w.Write(jsonError("method not allowed - use POST"))
+		return
+	}
+	authRequest := makeAuthRequest(r, []string{metricName}, nil)
+	authRequest.Write = true
+	if !s.authorize(w, authRequest) {
+		return
+	}
+	metric, ok := s.findMetric(metricName)
+	if !ok {
+		s.addHeaders(w, 404)
+		w.Write([]byte("{\"error\": \"metric not found - " + metricName + "\"}"))
+		return
+	}
+	var points Points
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIngestBytes)).Decode(&points); err != nil {
+		s.addHeaders(w, 400)
+		w.Write(jsonError("invalid points - " + err.Error()))
+		return
+	}
+	if err := s.publish(r.Context(), metric.Name, points); err == errNotStarted {
+		s.addHeaders(w, 503)
+		w.Write([]byte(serviceUnavailable))
+		return
+	} else if err != nil {
+		//the client went away
+		return
+	}
+	s.addHeaders(w, 202)
+	w.Write([]byte("{\"accepted\": " + strconv.Itoa(len(points)) + "}"))
+}
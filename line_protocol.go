@@ -0,0 +1,227 @@
+package metrik
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//parseLineProtocol parses points written in InfluxDB line protocol, eg.
+//
+//	power,region=uk,asset=battery value=1.2,capacity=5i 1476698400000000000
+//
+//Each numeric or boolean field becomes a point of the metric named after the measurement if the
+//field is called "value", or measurement_field otherwise (so the line above is a point of "power"
+//and one of "power_capacity"). String fields and timestamps are ignored: the points replace the
+//current snapshot of their metric. The points are returned keyed by metric name.
+func parseLineProtocol(r io.Reader) (map[string]Points, error) {
+	ret := make(map[string]Points)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxIngestBytes)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if err := parseLine(line, ret); err != nil {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func parseLine(line string, points map[string]Points) error {
+	sections := splitUnescaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return errors.New("expected measurement, fields and optional timestamp")
+	}
+	if len(sections) == 3 {
+		if _, err := strconv.ParseInt(sections[2], 10, 64); err != nil {
+			return errors.New("invalid timestamp - " + sections[2])
+		}
+	}
+
+	series := splitUnescaped(sections[0], ',', false)
+	measurement := unescape(series[0])
+	if measurement == "" {
+		return errors.New("missing measurement")
+	}
+	tags := make(Tags)
+	for _, pair := range series[1:] {
+		kv := splitUnescaped(pair, '=', false)
+		if len(kv) != 2 || kv[0] == "" {
+			return errors.New("invalid tag - " + pair)
+		}
+		key := unescape(kv[0])
+		tags[key] = append(tags[key], unescape(kv[1]))
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',', true) {
+		kv := splitUnescaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return errors.New("invalid field - " + field)
+		}
+		val, ok, err := parseFieldValue(kv[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			//string field
+			continue
+		}
+		name := measurement
+		if key := unescape(kv[0]); key != "value" {
+			name += "_" + key
+		}
+		points[name] = append(points[name], Point{Tags: tags, Value: val})
+	}
+	return nil
+}
+
+//parseFieldValue parses a float, integer (1i), unsigned (1u) or boolean field value. The bool is false
+//for string fields, which have no numeric value.
+func parseFieldValue(s string) (float64, bool, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if s[0] == '"' {
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return 0, false, errors.New("unterminated string field - " + s)
+		}
+		return 0, false, nil
+	}
+	if last := s[len(s)-1]; last == 'i' || last == 'u' {
+		s = s[:len(s)-1]
+		if last == 'i' {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return 0, false, errors.New("invalid integer field value - " + s)
+			}
+			return float64(v), true, nil
+		}
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, false, errors.New("invalid unsigned field value - " + s)
+		}
+		return float64(v), true, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		//line protocol has no NaN or infinite values, and they can't be encoded as JSON
+		return 0, false, errors.New("invalid field value - " + s)
+	}
+	return v, true, nil
+}
+
+//splitUnescaped splits s on every occurrence of sep that isn't escaped by a backslash and, if
+//quotes is true, isn't inside a double-quoted string. The parts are not unescaped. Line protocol
+//only has one separator between key and value, so splitting on '=' stops at the first one.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var (
+		parts    []string
+		start    int
+		inQuotes bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++ //skip the escaped character
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+			if sep == '=' {
+				return append(parts, s[start:])
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+//unescape removes the backslashes escaping commas, spaces, equal signs and backslashes.
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(", =\\\"", s[i+1]) != -1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+//handles requests of the form POST /write with InfluxDB line protocol as the body, so that
+//collectors such as Telegraf can publish points. Query parameters (eg. db) are ignored. The
+//request is authorized before the body is read, without metrics, and again once the metrics
+//are known.
+func (s *Server) lineProtocolHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		s.addHeaders(w, 405)
+		w.Write(jsonError("method not allowed - use POST"))
+		return
+	}
+	authRequest := makeAuthRequest(r, nil, nil)
+	authRequest.Write = true
+	if !s.authorize(w, authRequest) {
+		return
+	}
+	points, err := parseLineProtocol(http.MaxBytesReader(w, r.Body, maxIngestBytes))
+	if err != nil {
+		s.addHeaders(w, 400)
+		w.Write(jsonError("unable to parse - " + err.Error()))
+		return
+	}
+	var (
+		metrics []*Metric
+		unknown []string
+		names   = make([]string, 0, len(points))
+	)
+	for name := range points {
+		if metric, ok := s.findMetric(name); ok {
+			metrics = append(metrics, metric)
+			names = append(names, name)
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	authRequest.Metrics = append(names, unknown...)
+	if !s.authorize(w, authRequest) {
+		return
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		s.addHeaders(w, 400)
+		w.Write(jsonError("unknown measurements - " + strings.Join(unknown, ", ")))
+		return
+	}
+	for i, metric := range metrics {
+		if err := s.publish(r.Context(), metric.Name, points[names[i]]); err == errNotStarted {
+			s.addHeaders(w, 503)
+			w.Write([]byte(serviceUnavailable))
+			return
+		} else if err != nil {
+			//the client went away
+			return
+		}
+	}
+	w.Header().Add("Access-Control-Allow-Origin", s.crossDomainOrigin)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,103 @@
+package metrik
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	body := `# comment
+power,region=uk,asset=battery value=1.5,capacity=5i,online=t,label="a b=c" 1476698400000000000
+power,region=fr value=-2e1
+cpu\ load,host=a\,b\ c,path=x\=y usage_idle=0.5
+
+`
+	points, err := parseLineProtocol(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(points) != 4 {
+		t.Fatalf("expected 4 metrics, instead got %v", points)
+	}
+	if p := points["power"]; len(p) != 2 || p[0].Value != 1.5 || p[0].Tags["region"][0] != "uk" || p[1].Value != -20 {
+		t.Errorf("unexpected power points %+v", p)
+	}
+	if p := points["power_capacity"]; len(p) != 1 || p[0].Value != 5 || p[0].Tags["asset"][0] != "battery" {
+		t.Errorf("unexpected power_capacity points %+v", p)
+	}
+	if p := points["power_online"]; len(p) != 1 || p[0].Value != 1 {
+		t.Errorf("unexpected power_online points %+v", p)
+	}
+	if p := points["cpu load_usage_idle"]; len(p) != 1 || p[0].Tags["host"][0] != "a,b c" || p[0].Tags["path"][0] != "x=y" {
+		t.Errorf("unexpected escaped points %+v", p)
+	}
+	if _, ok := points["power_label"]; ok {
+		t.Errorf("expected string fields to be ignored")
+	}
+
+	for _, line := range []string{
+		"power",
+		"power value=",
+		"power value=abc",
+		"power value=1 yesterday",
+		"power,region value=1",
+		`power label="unterminated`,
+	} {
+		if _, err := parseLineProtocol(strings.NewReader(line)); err == nil {
+			t.Errorf("expected error parsing %q", line)
+		}
+	}
+}
+
+func TestLineProtocolHandler(t *testing.T) {
+	s := NewServer().Ingestion(true)
+	s.Metric(&Metric{Name: "power"})
+	ts := startServer(t, s)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	for body, status := range map[string]int{
+		"power,region=uk value=1\npower,region=fr value=2": 204,
+		"power,region=uk value=1\nunknown value=2":         400,
+		"power,region=uk value=NaN":                        400,
+		"power,region=uk value=+Inf":                       400,
+	} {
+		resp, err := http.Post(ts.URL+"/write?db=telegraf", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expected status %v for %q, instead got %v", status, body, resp.StatusCode)
+		}
+	}
+
+	var total TotalAggregateResponse
+	get(t, ts.URL+"/sum/power", &total)
+	if len(total.Metrics) != 1 || total.Metrics[0].Value != 3 {
+		t.Errorf("expected sum to be 3, instead got %+v", total)
+	}
+}
+
+func TestLineProtocolAuth(t *testing.T) {
+	s := NewServer().Ingestion(true).Auth(writeOnlyAuth{})
+	s.Metric(&Metric{Name: "power"})
+	ts := startServer(t, s)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	//the body isn't read if the user can't write, so it isn't reported as invalid
+	for user, status := range map[string]int{"reader": 403, "writer": 400} {
+		req, _ := http.NewRequest("POST", ts.URL+"/write", strings.NewReader("power,region=uk"))
+		req.SetBasicAuth(user, "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expected status %v for %s, instead got %v", status, user, resp.StatusCode)
+		}
+	}
+}
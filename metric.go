@@ -7,14 +7,15 @@ import (
 
 //Point represents a tagged real-time metric value (e.g. Most recent CPU usage tagged with {"machine": "testserver"})
 type Point struct {
-	Tags  Tags
-	Value float64
+	Tags  Tags    `json:"tags"`
+	Value float64 `json:"value"`
 }
 
 //Points is a collection of metric points over the whole population.
 type Points []Point
 
 //Updater is a function that runs the an update routine. It should block. It should publish values through the first channel, and accept a stop command on the second.
+//The stop channel is closed when the server shuts down, so the updater should return as soon as it can be received from.
 type Updater func(chan Points, chan bool) error
 
 //Metric provides an interface between the data fetcher and the aggregator.
@@ -22,7 +23,7 @@ type Metric struct {
 	Name        string  `json:"name"`        //Short name for metric. Should be URL-friendly.
 	Units       string  `json:"units"`       //Units for the metric, for example "Kw".
 	Description string  `json:"description"` //Description of the metric, for users.
-	UpdateFunc  Updater `json:"-"`
+	UpdateFunc  Updater `json:"-"`           //Updater for the metric. It can be nil if points are only pushed through the HTTP API.
 }
 
 //PollUpdater is a utility function to convert a periodic polling updater to Updater type, catching
@@ -46,7 +47,11 @@ func PollUpdater(fetch func() (Points, error), interval time.Duration) Updater {
 				if err != nil {
 					return err
 				}
-				result <- points
+				select {
+				case result <- points:
+				case <-stop:
+					return nil
+				}
 			case <-stop:
 				return nil
 			}
@@ -0,0 +1,259 @@
+package metrik
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	prometheusAccept      = "text/plain;version=0.0.4"
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+//PromScrapeUpdater is an Updater that scrapes a Prometheus text-format endpoint, such as the
+//metrics page of an exporter, every interval and publishes the samples of the metric called
+//metricName as points. The labels of each sample become its tags. Samples that aren't finite
+//(NaN, +Inf) are skipped.
+func PromScrapeUpdater(url string, metricName string, interval time.Duration) Updater {
+	client := &http.Client{Timeout: interval}
+	return PollUpdater(func() (Points, error) {
+		return scrapePrometheus(client, url, metricName)
+	}, interval)
+}
+
+func scrapePrometheus(client *http.Client, url string, metricName string) (Points, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", prometheusAccept)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New("scraping " + url + ": unexpected status " + resp.Status)
+	}
+	return parsePrometheusText(resp.Body, metricName)
+}
+
+//parsePrometheusText parses the Prometheus text exposition format, returning the samples of the
+//metric called metricName as points.
+func parsePrometheusText(r io.Reader, metricName string) (Points, error) {
+	var points Points
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, tags, value, err := parsePrometheusSample(line)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+		if name != metricName || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		points = append(points, Point{Tags: tags, Value: value})
+	}
+	return points, scanner.Err()
+}
+
+//parsePrometheusSample parses a line of the form name[{label="value",...}] value [timestamp]
+func parsePrometheusSample(line string) (string, Tags, float64, error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i < 1 {
+		return "", nil, 0, errors.New("missing metric name or value")
+	}
+	name, rest := line[:i], line[i:]
+	tags := make(Tags)
+	if rest[0] == '{' {
+		var err error
+		if rest, err = parsePrometheusLabels(rest[1:], tags); err != nil {
+			return "", nil, 0, err
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return "", nil, 0, errors.New("expected value and optional timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, errors.New("invalid value - " + fields[0])
+	}
+	return name, tags, value, nil
+}
+
+//parsePrometheusLabels parses the labels following the opening brace into tags, and returns what
+//follows the closing brace.
+func parsePrometheusLabels(s string, tags Tags) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return "", errors.New("unterminated labels")
+		}
+		if s[0] == '}' {
+			return s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 1 {
+			return "", errors.New("invalid label - " + s)
+		}
+		label := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if s == "" || s[0] != '"' {
+			return "", errors.New("expected quoted value for label " + label)
+		}
+		var (
+			value  strings.Builder
+			closed bool
+			i      int
+		)
+		for i = 1; i < len(s); i++ {
+			if s[i] == '"' {
+				closed = true
+				break
+			}
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if !closed {
+			return "", errors.New("unterminated value for label " + label)
+		}
+		tags[label] = append(tags[label], value.String())
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		}
+	}
+}
+
+//handles requests of the form GET /export/prometheus, writing the points of the latest snapshot of
+//every metric in the Prometheus text exposition format, with their tags as labels. Multi-valued
+//tags are joined with commas.
+func (s *Server) prometheusExportHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, len(s.metrics))
+	for i, metric := range s.metrics {
+		names[i] = metric.Name
+	}
+	if !s.authorize(w, makeAuthRequest(r, names, nil)) {
+		return
+	}
+	var buf bytes.Buffer
+	for _, metric := range s.metrics {
+		if index, ok := s.latestIndex(metric.Name); ok {
+			writePrometheusMetric(&buf, metric, index.Points)
+		}
+	}
+	w.Header().Add("Content-Type", prometheusContentType)
+	w.Header().Add("Access-Control-Allow-Origin", s.crossDomainOrigin)
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+//writePrometheusMetric writes the points of the metric in the Prometheus text format. If several
+//points have the same labels, only the first one is written.
+func writePrometheusMetric(buf *bytes.Buffer, metric *Metric, points Points) {
+	name := prometheusName(metric.Name, true)
+	help := metric.Description
+	if metric.Units != "" {
+		help += " (" + metric.Units + ")"
+	}
+	buf.WriteString("# HELP " + name + " " + prometheusHelpEscaper.Replace(help) + "\n")
+	buf.WriteString("# TYPE " + name + " gauge\n")
+	seen := make(map[string]bool, len(points))
+	for _, point := range points {
+		labels := prometheusLabels(point.Tags)
+		if seen[labels] {
+			//Prometheus rejects scrapes with duplicate series
+			continue
+		}
+		seen[labels] = true
+		buf.WriteString(name)
+		buf.WriteString(labels)
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(point.Value, 'g', -1, 64))
+		buf.WriteByte('\n')
+	}
+}
+
+//prometheusLabels returns the tags as a Prometheus label set, eg. {region="uk"}, sorted by label
+//name. Tags whose names are the same once sanitized (eg. asset-type and asset_type) are merged
+//into one label, with the values of both.
+func prometheusLabels(tags Tags) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var (
+		names  = make([]string, 0, len(keys))
+		values = make(map[string][]string, len(keys))
+	)
+	for _, key := range keys {
+		name := prometheusName(key, false)
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = append(values[name], tags[key]...)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(prometheusLabelEscaper.Replace(strings.Join(values[name], ",")))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	prometheusHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+//prometheusName replaces the characters that aren't allowed in Prometheus metric names (or label
+//names, which can't contain colons) by underscores.
+func prometheusName(s string, metric bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9' && i > 0) || (metric && c == ':')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
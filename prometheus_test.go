@@ -0,0 +1,149 @@
+package metrik
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const exposition = `# HELP node_power_watts Power draw.
+# TYPE node_power_watts gauge
+node_power_watts{region="uk",asset="battery"} 1.5
+node_power_watts{region="fr" , asset="solar",} 2 1476698400000
+node_power_watts{region="a \"quoted\" \\ region\n"} 3
+node_power_watts{region="nowhere"} NaN
+node_power_watts 4
+node_cpu_seconds_total{cpu="0"} 100
+`
+
+func TestParsePrometheusText(t *testing.T) {
+	points, err := parsePrometheusText(strings.NewReader(exposition), "node_power_watts")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(points) != 4 {
+		t.Fatalf("expected 4 points, instead got %+v", points)
+	}
+	if p := points[0]; p.Value != 1.5 || p.Tags["region"][0] != "uk" || p.Tags["asset"][0] != "battery" {
+		t.Errorf("unexpected point %+v", p)
+	}
+	if p := points[1]; p.Value != 2 || p.Tags["asset"][0] != "solar" {
+		t.Errorf("unexpected point %+v", p)
+	}
+	if p := points[2]; p.Tags["region"][0] != "a \"quoted\" \\ region\n" {
+		t.Errorf("expected escaped label to be unescaped, instead got %q", p.Tags["region"][0])
+	}
+	if p := points[3]; p.Value != 4 || len(p.Tags) != 0 {
+		t.Errorf("unexpected point %+v", p)
+	}
+
+	for _, line := range []string{
+		`node_power_watts{region="uk"`,
+		`node_power_watts{region=uk} 1`,
+		`node_power_watts{region="uk} 1`,
+		`node_power_watts abc`,
+		`node_power_watts`,
+	} {
+		if _, err := parsePrometheusText(strings.NewReader(line), "node_power_watts"); err == nil {
+			t.Errorf("expected error parsing %q", line)
+		}
+	}
+}
+
+func TestPromScrapeUpdater(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(exposition))
+	}))
+	defer exporter.Close()
+
+	result, stop := make(chan Points, 1), make(chan bool)
+	go PromScrapeUpdater(exporter.URL, "node_cpu_seconds_total", 10*time.Millisecond)(result, stop)
+	defer close(stop)
+	select {
+	case points := <-result:
+		if len(points) != 1 || points[0].Value != 100 || points[0].Tags["cpu"][0] != "0" {
+			t.Errorf("unexpected points %+v", points)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected points to be published")
+	}
+}
+
+func TestPrometheusExport(t *testing.T) {
+	s := NewServer().Ingestion(true)
+	s.Metric(&Metric{Name: "power", Units: "kW", Description: "Power draw"})
+	s.Metric(&Metric{Name: "memory"})
+	ts := startServer(t, s)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	body := `[{"tags": {"region": ["uk"], "asset-type": ["battery", "solar"]}, "value": 1.5}, {"tags": {"region": ["a \"b\""]}, "value": 2}]`
+	resp, err := http.Post(ts.URL+"/ingest/power", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 202 {
+		t.Fatalf("expected points to be accepted, instead got status %v", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := http.Get(ts.URL + "/export/prometheus")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		points, err := parsePrometheusText(resp.Body, "power")
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("could not parse export: %v", err)
+		}
+		if len(points) == 2 {
+			if p := points[0]; p.Value != 1.5 || p.Tags["asset_type"][0] != "battery,solar" || p.Tags["region"][0] != "uk" {
+				t.Errorf("unexpected point %+v", p)
+			}
+			if p := points[1]; p.Value != 2 || p.Tags["region"][0] != `a "b"` {
+				t.Errorf("unexpected point %+v", p)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 exported points, instead got %+v", points)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPrometheusDuplicateLabels(t *testing.T) {
+	var buf bytes.Buffer
+	writePrometheusMetric(&buf, &Metric{Name: "power"}, Points{
+		{Tags: Tags{"asset-type": {"battery"}, "asset_type": {"solar"}, "region": {"uk"}}, Value: 1},
+	})
+	if expected := `power{asset_type="battery,solar",region="uk"} 1`; !strings.Contains(buf.String(), expected+"\n") {
+		t.Errorf("expected the labels to be merged into %s, instead got %s", expected, buf.String())
+	}
+	if _, err := parsePrometheusText(&buf, "power"); err != nil {
+		t.Errorf("could not parse export: %v", err)
+	}
+}
+
+func TestPrometheusDuplicateSeries(t *testing.T) {
+	var buf bytes.Buffer
+	writePrometheusMetric(&buf, &Metric{Name: "power"}, Points{
+		{Tags: Tags{"region": {"uk"}}, Value: 1},
+		{Tags: Tags{"region": {"fr"}}, Value: 2},
+		{Tags: Tags{"region": {"uk"}}, Value: 3},
+		{Tags: Tags{"asset-type": {"solar"}}, Value: 4},
+		{Tags: Tags{"asset_type": {"solar"}}, Value: 5},
+	})
+	points, err := parsePrometheusText(&buf, "power")
+	if err != nil {
+		t.Fatalf("could not parse export: %v", err)
+	}
+	if len(points) != 3 || points[0].Value != 1 || points[1].Value != 2 || points[2].Value != 4 {
+		t.Errorf("expected only the first point of each series, instead got %+v", points)
+	}
+}
@@ -1,5 +1,9 @@
 package metrik
 
+import (
+	"time"
+)
+
 type metricListResponse struct {
 	Metrics []*Metric `json:"metrics"`
 }
@@ -32,6 +36,52 @@ type GroupbyAggregateResponse struct {
 	Metrics []GroupbyAggregateResponseItem `json:"metrics"`
 }
 
+//TotalAggregateSeriesItem represents the response that the HTTP/JSON API will send to total aggregate
+//queries over a time window, eg. /sum/metric?from=2016-10-17T10:00:00Z.
+type TotalAggregateSeriesItem struct {
+	Name   string       `json:"name"`
+	Series []timedValue `json:"series"`
+}
+
+//GroupbyAggregateSeriesItem represents the response that the HTTP/JSON API will send to group-by aggregate
+//queries over a time window, eg. /sum/metric/by/tag?from=2016-10-17T10:00:00Z.
+type GroupbyAggregateSeriesItem struct {
+	Name   string        `json:"name"`
+	Series []timedGroups `json:"series"`
+}
+
+//TotalAggregateSeriesResponse is an array of aggregated metric time series.
+type TotalAggregateSeriesResponse struct {
+	Metrics []TotalAggregateSeriesItem `json:"metrics"`
+}
+
+//GroupbyAggregateSeriesResponse is an array of group-by aggregated metric time series.
+type GroupbyAggregateSeriesResponse struct {
+	Metrics []GroupbyAggregateSeriesItem `json:"metrics"`
+}
+
+type timedValue struct {
+	T     time.Time `json:"t"`
+	Value float64   `json:"value"`
+}
+
+type timedGroups struct {
+	T      time.Time `json:"t"`
+	Groups []group   `json:"groups"`
+}
+
+//PointsResponseItem represents the response that the HTTP/JSON API will send to point listing
+//queries, eg. /points/metric?tag=value.
+type PointsResponseItem struct {
+	Name   string `json:"name"`
+	Points Points `json:"points"`
+}
+
+//PointsResponse is an array of point listings.
+type PointsResponse struct {
+	Metrics []PointsResponseItem `json:"metrics"`
+}
+
 //TotalAggregateHook is an interface to hook and transform total aggregate responses.
 //the return type should be marshallable to JSON.
 type TotalAggregateHook func(TotalAggregateResponse) interface{}
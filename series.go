@@ -0,0 +1,181 @@
+package metrik
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultReducer = "average"
+
+//bucket splits snapshots, sorted by time, into consecutive buckets aligned on multiples of the interval.
+//Empty buckets are skipped.
+func bucket(snapshots []*timeSeriesItem, interval time.Duration) ([]time.Time, [][]*timeSeriesItem) {
+	var (
+		starts  []time.Time
+		buckets [][]*timeSeriesItem
+	)
+	for _, snapshot := range snapshots {
+		start := snapshot.T.Truncate(interval)
+		if len(starts) == 0 || !starts[len(starts)-1].Equal(start) {
+			starts = append(starts, start)
+			buckets = append(buckets, nil)
+		}
+		buckets[len(buckets)-1] = append(buckets[len(buckets)-1], snapshot)
+	}
+	return starts, buckets
+}
+
+//handles queries of the form GET /:aggregate/:metric_1[,:metric_2[,...:metric_n]][/by/:tag]/over/:interval
+//The aggregate is applied within each snapshot, then the reducer (?reduce=, by default the average)
+//is applied across the snapshots in each interval.
+func (s *Server) seriesHandlerWrapper(aggregate string) func(http.ResponseWriter, *http.Request) {
+	var (
+		agg      Aggregator
+		aggFound bool
+	)
+	if agg, aggFound = s.aggregates[aggregate]; !aggFound {
+		//this should never get reached
+		panic("url was matched by regexp but clearly does not satisfy it")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimRight(r.URL.Path[len(aggregate)+2:], "/")
+		i := strings.LastIndex(path, "/over/")
+		if i == -1 {
+			//we should never reach this
+			panic("url was matched by regexp but clearly does not satisfy it")
+		}
+		metricString, intervalString := path[:i], path[i+len("/over/"):]
+		var tag string
+		if parts := strings.Split(metricString, "/by/"); len(parts) == 2 {
+			metricString, tag = parts[0], parts[1]
+		}
+		metrics := strings.Split(metricString, ",")
+		var tags []string
+		if tag != "" {
+			tags = strings.Split(tag, ",")
+		}
+		if !s.authorize(w, makeAuthRequest(r, metrics, tags)) {
+			return
+		}
+		interval, err := time.ParseDuration(intervalString)
+		if err != nil || interval <= 0 {
+			s.addHeaders(w, 400)
+			w.Write(jsonError("invalid interval - " + intervalString + " (expected a duration such as 5m)"))
+			return
+		}
+		reducerName := r.URL.Query().Get("reduce")
+		if reducerName == "" {
+			reducerName = defaultReducer
+		}
+		reducer, ok := s.aggregates[reducerName]
+		if !ok {
+			s.addHeaders(w, 400)
+			w.Write(jsonError("unknown reducer - " + reducerName))
+			return
+		}
+		filter, err := s.requestFilter(r.URL, metrics)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		tq, err := parseTimeQuery(r.URL)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		if !tq.At.IsZero() {
+			s.addHeaders(w, 400)
+			w.Write(jsonError("at cannot be used with /over/, use from and to instead"))
+			return
+		}
+		tq.Window = true
+		options, err := parseGroupOptions(r.URL)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+
+		if tag == "" {
+			var retval TotalAggregateSeriesResponse
+			retval.Metrics = make([]TotalAggregateSeriesItem, 0, len(metrics))
+			for _, metricName := range metrics {
+				snapshots, ok := s.snapshots(w, metricName, tq)
+				if !ok {
+					return
+				}
+				starts, buckets := bucket(snapshots, interval)
+				item := TotalAggregateSeriesItem{
+					Name:   metricName,
+					Series: make([]timedValue, 0, len(buckets)),
+				}
+				for i := range buckets {
+					vals := make([]float64, 0, len(buckets[i]))
+					for _, snapshot := range buckets[i] {
+						if val, tagsFound := snapshot.Index.GetTotalAggregate(aggregatorAt(agg, snapshot.T), filter); tagsFound {
+							vals = append(vals, val)
+						}
+					}
+					if len(vals) > 0 {
+						item.Series = append(item.Series, timedValue{T: starts[i], Value: reducer.Apply(vals)})
+					}
+				}
+				retval.Metrics = append(retval.Metrics, item)
+			}
+			s.writeJSON(w, retval, "total aggregate series")
+			return
+		}
+
+		var retval GroupbyAggregateSeriesResponse
+		retval.Metrics = make([]GroupbyAggregateSeriesItem, 0, len(metrics))
+		for _, metricName := range metrics {
+			snapshots, ok := s.snapshots(w, metricName, tq)
+			if !ok {
+				return
+			}
+			starts, buckets := bucket(snapshots, interval)
+			item := GroupbyAggregateSeriesItem{
+				Name:   metricName,
+				Series: make([]timedGroups, 0, len(buckets)),
+			}
+			for i := range buckets {
+				vals := make(map[string][]float64)
+				keys := make(map[string][]string)
+				counts := make(map[string]int)
+				for _, snapshot := range buckets[i] {
+					groups, tagFound := snapshot.Index.groupBy(tags, aggregatorAt(agg, snapshot.T), filter)
+					if !tagFound {
+						continue
+					}
+					for _, g := range groups {
+						if g.Count > 0 {
+							//empty groups don't take part in the reduction
+							vals[g.Key] = append(vals[g.Key], g.Value)
+						} else if _, ok := vals[g.Key]; !ok {
+							vals[g.Key] = nil
+						}
+						keys[g.Key] = g.Keys
+						counts[g.Key] += g.Count
+					}
+				}
+				if len(vals) == 0 {
+					continue
+				}
+				groups := make([]group, 0, len(vals))
+				for key, v := range vals {
+					g := group{Key: key, Keys: keys[key], Count: counts[key]}
+					if len(v) > 0 {
+						g.Value = reducer.Apply(v)
+					}
+					groups = append(groups, g)
+				}
+				item.Series = append(item.Series, timedGroups{T: starts[i], Groups: options.apply(groups)})
+			}
+			retval.Metrics = append(retval.Metrics, item)
+		}
+		s.writeJSON(w, retval, "groupby aggregate series")
+	}
+}
@@ -1,7 +1,10 @@
 package metrik
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
@@ -40,6 +43,12 @@ const notFound = `
 {"error": "unknown route"}
 `
 
+const defaultHistorySize = 60
+
+//maxPendingSnapshots is the number of snapshots waiting to be written to the store, beyond which
+//new snapshots aren't persisted until the store catches up.
+const maxPendingSnapshots = 64
+
 //Server is an HTTP server for the Metrik JSON API. It exposes an interface to your users that allows them
 //to slice and dice metrics, performing operations such as group-by aggregates.
 type Server struct {
@@ -53,23 +62,34 @@ type Server struct {
 	taHook            TotalAggregateHook
 	gbHook            GroupbyAggregateHook
 	crossDomainOrigin string
+	ingestion         bool
 	_tagsMeta         []Tag
 	_mms              []byte
 	_tms              []byte
-	_indexes          map[string]invertedIndex
+	historySize       int
+	_history          map[string]*timeSeries
 	_ilocks           map[string]*sync.RWMutex
-	_stopChans        []chan bool
+	_updaters         []*runningUpdater
 	_updateChans      map[string]chan Points
+	_done             chan struct{} //closed to stop listenForChanges
+	_fanInDone        chan struct{} //closed when listenForChanges exits
+	_persist          chan snapshotUpdate
+	_persistDone      chan struct{} //closed when persistSnapshots exits
+	_stopFanIn        sync.Once
+	_httpServer       *http.Server
+	_lock             sync.Mutex //protects _httpServer
 }
 
 //NewServer creates a new Metrik server.
 func NewServer() *Server {
 	s := Server{
-		store:             &inMemoryStore{},
 		auth:              &openAPI{},
-		aggregates:        map[string]Aggregator{"sum": sum{}, "average": avg{}, "count": count{}},
+		aggregates:        defaultAggregates(),
 		indexHandler:      defaultIndexHandler,
 		crossDomainOrigin: "*",
+		historySize:       defaultHistorySize,
+		_history:          make(map[string]*timeSeries),
+		_ilocks:           make(map[string]*sync.RWMutex),
 	}
 	return &s
 }
@@ -94,6 +114,28 @@ func (s *Server) GroupbyAggregateHook(f GroupbyAggregateHook) *Server {
 	return s
 }
 
+//HistorySize sets the number of snapshots of each metric that are kept in memory to answer
+//historical queries (eg. /sum/metric?at=2016-10-17T10:00:00Z), and persisted if there is a store.
+//The default is 60, and at least 1 snapshot is always kept. It should be called before Serve().
+func (s *Server) HistorySize(n int) *Server {
+	if n < 1 {
+		n = 1
+	}
+	s.historySize = n
+	for name := range s._history {
+		s._history[name] = newTimeSeries(n)
+	}
+	return s
+}
+
+//Ingestion enables the POST /ingest/:metric and POST /write (InfluxDB line protocol) routes, which
+//let clients publish points over HTTP instead of through an Updater. It is disabled by default. Requests are passed to the
+//AuthProvider with AuthRequest.Write set, so make sure it doesn't allow anyone to write.
+func (s *Server) Ingestion(enabled bool) *Server {
+	s.ingestion = enabled
+	return s
+}
+
 //Logger sets the logger for the Metrik server.
 func (s *Server) Logger(l *log.Logger) *Server {
 	s.logger = l
@@ -103,14 +145,21 @@ func (s *Server) Logger(l *log.Logger) *Server {
 //Metric registers a metric.
 func (s *Server) Metric(m *Metric) *Server {
 	s.metrics = append(s.metrics, m)
+	s._ilocks[m.Name] = &sync.RWMutex{}
+	s._history[m.Name] = newTimeSeries(s.historySize)
 	s.logf("added metric %s", m.Name)
 	return s
 }
 
 //Aggregate registers an aggregate.
 func (s *Server) Aggregate(a Aggregator, name string) *Server {
+	if b, ok := a.(interface {
+		bind(*Server)
+	}); ok {
+		//the aggregate depends on other metrics
+		b.bind(s)
+	}
 	s.aggregates[name] = a
-	s._indexes[name] = newInvertedIndex()
 	return s
 }
 
@@ -121,7 +170,10 @@ func (s *Server) Tag(t *Tag) *Server {
 	return s
 }
 
-//Store registers a store (currently unused).
+//Store registers a store, used to persist the history of each metric so that it can be restored
+//when the server restarts. By default the history isn't persisted. Snapshots are marshaled and
+//written in the background, one at a time, so a slow store delays persistence rather than updates.
+//The store is closed by Shutdown().
 func (s *Server) Store(st Store) *Server {
 	s.store = st
 	return s
@@ -187,64 +239,316 @@ func (s *Server) totalAggHandlerWrapper(aggregate string) func(http.ResponseWrit
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		metrics := strings.Split(r.URL.Path[len(aggregate)+2:], ",") // /sum/a,b,c -> [a,b,c]
-		if ok, err := s.auth.Authorize(makeAuthRequest(r, metrics, nil)); !ok && err == nil {
-			s.addHeaders(w, 403)
-			w.Write([]byte(unauthorized))
+		if !s.authorize(w, makeAuthRequest(r, metrics, nil)) {
 			return
-		} else if err != nil {
-			s.addHeaders(w, 500)
-			w.Write([]byte(internalError))
+		}
+		filter, err := s.requestFilter(r.URL, metrics)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		tq, err := parseTimeQuery(r.URL)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		if tq.IsSeries() {
+			var retval TotalAggregateSeriesResponse
+			retval.Metrics = make([]TotalAggregateSeriesItem, 0, len(metrics))
+			for _, metricName := range metrics {
+				snapshots, ok := s.snapshots(w, metricName, tq)
+				if !ok {
+					return
+				}
+				item := TotalAggregateSeriesItem{
+					Name:   metricName,
+					Series: make([]timedValue, 0, len(snapshots)),
+				}
+				for _, snapshot := range snapshots {
+					if val, tagsFound := snapshot.Index.GetTotalAggregate(aggregatorAt(agg, snapshot.T), filter); tagsFound {
+						item.Series = append(item.Series, timedValue{T: snapshot.T, Value: val})
+					}
+				}
+				retval.Metrics = append(retval.Metrics, item)
+			}
+			s.writeJSON(w, retval, "total aggregate series")
 			return
 		}
 		var retval TotalAggregateResponse
 		retval.Metrics = make([]TotalAggregateResponseItem, 0, len(metrics))
 		for _, metricName := range metrics {
-			if index, ok := s._indexes[metricName]; ok {
-				filter := parseFilter(r.URL)
-				s._ilocks[metricName].RLock()
-				val, tagsFound := index.GetTotalAggregate(agg, filter)
-				s._ilocks[metricName].RUnlock()
-				if tagsFound == false {
-					s.addHeaders(w, 404)
-					w.Write([]byte("{\"error\": \"one or more tags in predicate not found\"}"))
-					return
-				}
-				retval.Metrics = append(retval.Metrics, TotalAggregateResponseItem{
-					Name:  metricName,
-					Value: val,
-				})
-
-			} else {
+			snapshots, ok := s.snapshots(w, metricName, tq)
+			if !ok {
+				return
+			}
+			val, tagsFound := snapshots[0].Index.GetTotalAggregate(aggregatorAt(agg, snapshots[0].T), filter)
+			if tagsFound == false {
 				s.addHeaders(w, 404)
-				w.Write([]byte("{\"error\": \"metric not found - " + metricName + "\"}"))
+				w.Write([]byte("{\"error\": \"one or more tags in predicate not found\"}"))
 				return
 			}
+			retval.Metrics = append(retval.Metrics, TotalAggregateResponseItem{
+				Name:  metricName,
+				Value: val,
+			})
 		}
-		s.addHeaders(w, 200)
 		if s.taHook != nil {
-			newResponse := s.taHook(retval)
-			b, err := json.Marshal(newResponse)
-			if err != nil {
-				s.addHeaders(w, 500)
-				s.logf("error in hooked total aggregate %v", err)
-				w.Write([]byte(internalError))
-				return
-			}
-			w.Write(b)
+			s.writeJSON(w, s.taHook(retval), "hooked total aggregate")
+			return
 		}
-		b, err := json.Marshal(retval)
-		if err != nil {
-			s.addHeaders(w, 500)
-			s.logf("error in total aggregate %v", err)
-			w.Write([]byte(internalError))
+		s.writeJSON(w, retval, "total aggregate")
+	}
+}
+
+//latestIndex returns the index of the latest snapshot of the metric, if any.
+func (s *Server) latestIndex(metric string) (invertedIndex, bool) {
+	series, ok := s._history[metric]
+	if !ok {
+		return invertedIndex{}, false
+	}
+	s._ilocks[metric].RLock()
+	snapshot := series.Latest()
+	s._ilocks[metric].RUnlock()
+	if snapshot == nil {
+		return invertedIndex{}, false
+	}
+	return snapshot.Index, true
+}
+
+//indexAt returns the index of the snapshot of the metric in effect at t, if any.
+func (s *Server) indexAt(metric string, t time.Time) (invertedIndex, bool) {
+	series, ok := s._history[metric]
+	if !ok {
+		return invertedIndex{}, false
+	}
+	s._ilocks[metric].RLock()
+	snapshot := series.At(t)
+	s._ilocks[metric].RUnlock()
+	if snapshot == nil {
+		return invertedIndex{}, false
+	}
+	return snapshot.Index, true
+}
+
+//handles queries of the form GET /points/:metric_1[,:metric_2[,...:metric_n]], listing the
+//points of the metrics, optionally filtered by tags.
+func (s *Server) pointsHandler(w http.ResponseWriter, r *http.Request) {
+	metrics := strings.Split(strings.Trim(r.URL.Path[len("/points/"):], "/"), ",")
+	if !s.authorize(w, makeAuthRequest(r, metrics, nil)) {
+		return
+	}
+	filter, err := s.requestFilter(r.URL, metrics)
+	if err != nil {
+		s.addHeaders(w, 400)
+		w.Write(jsonError(err.Error()))
+		return
+	}
+	tq, err := parseTimeQuery(r.URL)
+	if err != nil {
+		s.addHeaders(w, 400)
+		w.Write(jsonError(err.Error()))
+		return
+	}
+	if tq.IsSeries() {
+		s.addHeaders(w, 400)
+		w.Write(jsonError("from and to cannot be used to list points, use at instead"))
+		return
+	}
+	var retval PointsResponse
+	retval.Metrics = make([]PointsResponseItem, 0, len(metrics))
+	for _, metricName := range metrics {
+		snapshots, ok := s.snapshots(w, metricName, tq)
+		if !ok {
+			return
+		}
+		points, tagsFound := snapshots[0].Index.GetPoints(filter)
+		if !tagsFound {
+			s.addHeaders(w, 404)
+			w.Write([]byte("{\"error\": \"one or more tags in predicate not found\"}"))
 			return
 		}
-		w.Write(b)
+		if points == nil {
+			points = Points{}
+		}
+		retval.Metrics = append(retval.Metrics, PointsResponseItem{
+			Name:   metricName,
+			Points: points,
+		})
 	}
+	s.writeJSON(w, retval, "points")
 }
 
-func parseFilter(u *url.URL) Tags {
-	return Tags(u.Query())
+//handles requests of the form GET /distinct/:metrics/:tag, estimating the number of distinct values
+//of the tag among the (optionally filtered) points of each metric.
+func (s *Server) distinctHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/distinct/"):], "/"), "/")
+	if len(parts) != 2 {
+		//we should never reach this
+		panic("url was matched by regexp but clearly does not satisfy it")
+	}
+	metrics, tag := strings.Split(parts[0], ","), parts[1]
+	if !s.authorize(w, makeAuthRequest(r, metrics, []string{tag})) {
+		return
+	}
+	filter, err := s.requestFilter(r.URL, metrics)
+	if err != nil {
+		s.addHeaders(w, 400)
+		w.Write(jsonError(err.Error()))
+		return
+	}
+	tq, err := parseTimeQuery(r.URL)
+	if err != nil {
+		s.addHeaders(w, 400)
+		w.Write(jsonError(err.Error()))
+		return
+	}
+	if tq.IsSeries() {
+		s.addHeaders(w, 400)
+		w.Write(jsonError("from and to cannot be used to count distinct values, use at instead"))
+		return
+	}
+	var retval TotalAggregateResponse
+	retval.Metrics = make([]TotalAggregateResponseItem, 0, len(metrics))
+	for _, metricName := range metrics {
+		snapshots, ok := s.snapshots(w, metricName, tq)
+		if !ok {
+			return
+		}
+		val, tagsFound := snapshots[0].Index.GetDistinctCount(tag, filter)
+		if !tagsFound {
+			s.addHeaders(w, 404)
+			w.Write([]byte("{\"error\": \"tag or one or more tags in predicate not found\"}"))
+			return
+		}
+		retval.Metrics = append(retval.Metrics, TotalAggregateResponseItem{
+			Name:  metricName,
+			Value: val,
+		})
+	}
+	if s.taHook != nil {
+		s.writeJSON(w, s.taHook(retval), "hooked distinct count")
+		return
+	}
+	s.writeJSON(w, retval, "distinct count")
+}
+
+//snapshots returns the snapshots of the metric selected by the time query: the most recent
+//one, the one in effect at a given time, or all of those in a time window. If the metric
+//or snapshot can't be found it writes an error response and returns false.
+func (s *Server) snapshots(w http.ResponseWriter, metricName string, tq timeQuery) ([]*timeSeriesItem, bool) {
+	series, ok := s._history[metricName]
+	if !ok {
+		s.addHeaders(w, 404)
+		w.Write([]byte("{\"error\": \"metric not found - " + metricName + "\"}"))
+		return nil, false
+	}
+	var snapshot *timeSeriesItem
+	s._ilocks[metricName].RLock()
+	switch {
+	case tq.IsSeries():
+		snapshots := series.Between(tq.From, tq.To)
+		s._ilocks[metricName].RUnlock()
+		return snapshots, true
+	case !tq.At.IsZero():
+		snapshot = series.At(tq.At)
+	default:
+		snapshot = series.Latest()
+	}
+	s._ilocks[metricName].RUnlock()
+	if snapshot == nil {
+		s.addHeaders(w, 404)
+		w.Write([]byte("{\"error\": \"no data for metric - " + metricName + "\"}"))
+		return nil, false
+	}
+	return []*timeSeriesItem{snapshot}, true
+}
+
+//writeJSON writes a successful response, or an internal server error if v can't be marshalled.
+func (s *Server) writeJSON(w http.ResponseWriter, v interface{}, kind string) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.addHeaders(w, 500)
+		s.logf("error in %s %v", kind, err)
+		w.Write([]byte(internalError))
+		return
+	}
+	s.addHeaders(w, 200)
+	w.Write(b)
+}
+
+func jsonError(message string) []byte {
+	b, _ := json.Marshal(map[string]string{"error": message})
+	return b
+}
+
+//timeQuery selects snapshots from the history of a metric. If it is zero, the most recent
+//snapshot is selected.
+type timeQuery struct {
+	At   time.Time //Snapshot in effect at this time
+	From time.Time //Start of the time window (inclusive)
+	To   time.Time //End of the time window (inclusive)
+	//Window selects every snapshot between From and To, even if both are zero
+	Window bool
+}
+
+//IsSeries returns true if the query selects a time window rather than a single snapshot.
+func (tq timeQuery) IsSeries() bool {
+	return tq.Window || !tq.From.IsZero() || !tq.To.IsZero()
+}
+
+func parseTimeQuery(u *url.URL) (timeQuery, error) {
+	var (
+		tq  timeQuery
+		err error
+	)
+	q := u.Query()
+	if tq.At, err = parseTime(q.Get("at")); err != nil {
+		return tq, err
+	}
+	if tq.From, err = parseTime(q.Get("from")); err != nil {
+		return tq, err
+	}
+	if tq.To, err = parseTime(q.Get("to")); err != nil {
+		return tq, err
+	}
+	if !tq.At.IsZero() && tq.IsSeries() {
+		return tq, errors.New("at cannot be combined with from or to")
+	}
+	return tq, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasPrefix(s, "-") {
+		//relative to now, eg. -6h
+		if d, err := time.ParseDuration(s); err == nil {
+			return time.Now().Add(d), nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return t, errors.New("invalid time - " + s + " (expected RFC3339 or a negative duration such as -6h)")
+	}
+	return t, nil
+}
+
+//authorize checks the request with the authentication provider. If it is not authorized
+//it writes an error response and returns false.
+func (s *Server) authorize(w http.ResponseWriter, a *AuthRequest) bool {
+	if ok, err := s.auth.Authorize(a); !ok && err == nil {
+		s.addHeaders(w, 403)
+		w.Write([]byte(unauthorized))
+		return false
+	} else if err != nil {
+		s.addHeaders(w, 500)
+		w.Write([]byte(internalError))
+		return false
+	}
+	return true
 }
 
 func makeAuthRequest(r *http.Request, metrics []string, tags []string) *AuthRequest {
@@ -273,132 +577,365 @@ func (s *Server) metricGroupByHandlerWrapper(aggregate string) func(http.Respons
 			//we should never reach this
 			panic("url was matched by regexp but clearly does not satisfy it")
 		}
-		metricString, tag := parts[0], parts[1]
-		metrics := strings.Split(metricString, ",")
-		if ok, err := s.auth.Authorize(makeAuthRequest(r, metrics, []string{tag})); !ok && err == nil {
-			s.addHeaders(w, 403)
-			w.Write([]byte(unauthorized))
+		metricString, tag := parts[0], strings.TrimRight(parts[1], "/")
+		metrics, tags := strings.Split(metricString, ","), strings.Split(tag, ",")
+		if !s.authorize(w, makeAuthRequest(r, metrics, tags)) {
 			return
-		} else if err != nil {
-			s.addHeaders(w, 500)
-			w.Write([]byte(internalError))
+		}
+		filter, err := s.requestFilter(r.URL, metrics)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
 			return
 		}
-		var retval GroupbyAggregateResponse
-		retval.Metrics = make([]GroupbyAggregateResponseItem, 0, len(metrics))
-		for _, metricName := range metrics {
-			if index, ok := s._indexes[metricName]; ok {
-				filter := parseFilter(r.URL)
-				s._ilocks[metricName].RLock()
-				groups, tagFound := index.GetGroupByAggregate(tag, agg, filter)
-				s._ilocks[metricName].RUnlock()
-				if !tagFound {
-					s.addHeaders(w, 404)
-					w.Write([]byte("{\"error\": \"tag not found - " + tag + "\"}"))
+		tq, err := parseTimeQuery(r.URL)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		options, err := parseGroupOptions(r.URL)
+		if err != nil {
+			s.addHeaders(w, 400)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		if tq.IsSeries() {
+			var retval GroupbyAggregateSeriesResponse
+			retval.Metrics = make([]GroupbyAggregateSeriesItem, 0, len(metrics))
+			for _, metricName := range metrics {
+				snapshots, ok := s.snapshots(w, metricName, tq)
+				if !ok {
 					return
 				}
-				retval.Metrics = append(retval.Metrics, GroupbyAggregateResponseItem{
+				item := GroupbyAggregateSeriesItem{
 					Name:   metricName,
-					Groups: groups,
-				})
-			} else {
-				s.addHeaders(w, 404)
-				w.Write([]byte("{\"error\": \"metric not found - " + metricName + "\"}"))
-				return
+					Series: make([]timedGroups, 0, len(snapshots)),
+				}
+				for _, snapshot := range snapshots {
+					if groups, tagFound := snapshot.Index.groupBy(tags, aggregatorAt(agg, snapshot.T), filter); tagFound {
+						item.Series = append(item.Series, timedGroups{T: snapshot.T, Groups: options.apply(groups)})
+					}
+				}
+				retval.Metrics = append(retval.Metrics, item)
 			}
+			s.writeJSON(w, retval, "groupby aggregate series")
+			return
 		}
-		if s.gbHook != nil {
-			newResponse := s.gbHook(retval)
-			s.addHeaders(w, 200)
-			b, err := json.Marshal(newResponse)
-			if err != nil {
-				s.addHeaders(w, 500)
-				s.logf("error in hooked groupby aggregate %v", err)
-				w.Write([]byte(internalError))
+		var retval GroupbyAggregateResponse
+		retval.Metrics = make([]GroupbyAggregateResponseItem, 0, len(metrics))
+		for _, metricName := range metrics {
+			snapshots, ok := s.snapshots(w, metricName, tq)
+			if !ok {
+				return
+			}
+			groups, tagFound := snapshots[0].Index.groupBy(tags, aggregatorAt(agg, snapshots[0].T), filter)
+			if !tagFound {
+				s.addHeaders(w, 404)
+				w.Write([]byte("{\"error\": \"tag not found - " + tag + "\"}"))
 				return
 			}
-			w.Write(b)
+			retval.Metrics = append(retval.Metrics, GroupbyAggregateResponseItem{
+				Name:   metricName,
+				Groups: options.apply(groups),
+			})
 		}
-		s.addHeaders(w, 200)
-		b, err := json.Marshal(retval)
-		if err != nil {
-			s.addHeaders(w, 500)
-			s.logf("error in groupby aggregate %v", err)
-			w.Write([]byte(internalError))
+		if s.gbHook != nil {
+			s.writeJSON(w, s.gbHook(retval), "hooked groupby aggregate")
 			return
 		}
-		w.Write(b)
+		s.writeJSON(w, retval, "groupby aggregate")
 	}
 }
 
 func (s *Server) logf(fmt string, vals ...interface{}) {
 	if s.logger != nil {
-		s.logger.Printf(fmt, vals)
+		s.logger.Printf(fmt, vals...)
 	}
 }
 
-func (s *Server) updaterWrapper(m *Metric) (chan Points, chan bool) {
-	result := make(chan Points, 1)
-	stop := make(chan bool)
+//runningUpdater is a handle on an updater goroutine started by updaterWrapper.
+type runningUpdater struct {
+	metric string
+	result chan Points
+	stop   chan bool
+	done   chan struct{} //closed when the updater goroutine exits
+	once   sync.Once
+}
+
+//signal tells the updater to stop, without blocking if it has already exited.
+func (u *runningUpdater) signal() {
+	u.once.Do(func() {
+		close(u.stop)
+	})
+}
+
+func (s *Server) updaterWrapper(m *Metric) *runningUpdater {
+	u := &runningUpdater{
+		metric: m.Name,
+		result: make(chan Points, 1),
+		stop:   make(chan bool),
+		done:   make(chan struct{}),
+	}
+	if m.UpdateFunc == nil {
+		//points are only pushed through the HTTP API
+		close(u.done)
+		return u
+	}
 	go func() {
+		defer close(u.done)
 		for {
-			err := m.UpdateFunc(result, stop)
-			if err != nil {
-				s.logf("updater %s exited with error: %v. retrying in 3 seconds... \n", m.Name, err)
-				time.Sleep(3 * time.Second) //Todo: Add some better retry logic here
-			} else {
+			err := m.UpdateFunc(u.result, u.stop)
+			if err == nil {
 				break
 			}
+			s.logf("updater %s exited with error: %v. retrying in 3 seconds... \n", m.Name, err)
+			select {
+			case <-time.After(3 * time.Second): //Todo: Add some better retry logic here
+			case <-u.stop:
+				s.logf("updater %s stopped while waiting to retry", m.Name)
+				return
+			}
 		}
 		s.logf("updater %s exited", m.Name)
 	}()
-	return result, stop
+	return u
 }
 
-//Start metric updaters.
-func (s *Server) startUpdaters() error {
+//Start starts the metric updaters in the background. Updates they publish are indexed and
+//served by the handler returned by Handler(). Start should only be called once.
+func (s *Server) Start() error {
+	if s._updateChans != nil {
+		return errors.New("updaters already started")
+	}
+	if s.store != nil {
+		if err := s.store.Initialize(); err != nil {
+			return err
+		}
+		s.restoreSnapshots()
+		s._persist = make(chan snapshotUpdate, maxPendingSnapshots)
+		s._persistDone = make(chan struct{})
+		go s.persistSnapshots()
+	}
 	s._updateChans = make(map[string]chan Points)
-	s._stopChans = make([]chan bool, 0, len(s.metrics))
-	s._ilocks = make(map[string]*sync.RWMutex)
+	s._updaters = make([]*runningUpdater, 0, len(s.metrics))
+	s._done = make(chan struct{})
+	s._fanInDone = make(chan struct{})
 	for _, metric := range s.metrics {
 		s.logf("starting updater for %s", metric.Name)
-		update, stop := s.updaterWrapper(metric)
-		s._updateChans[metric.Name] = update
-		s._stopChans = append(s._stopChans, stop)
-		s._ilocks[metric.Name] = &sync.RWMutex{}
+		u := s.updaterWrapper(metric)
+		s._updateChans[metric.Name] = u.result
+		s._updaters = append(s._updaters, u)
 	}
-	s._indexes = make(map[string]invertedIndex)
 
 	go s.listenForChanges()
 	return nil
 }
 
 func (s *Server) listenForChanges() {
+	defer close(s._fanInDone)
+	if s._persist != nil {
+		defer close(s._persist)
+	}
 	for {
 		for metric, ch := range s._updateChans {
 			select {
 			case newPoints := <-ch:
 				s.logf("received update for metric %s", metric)
+				snapshot := &timeSeriesItem{T: time.Now(), Index: newInvertedIndex()}
+				snapshot.Index.Index(newPoints)
 				s._ilocks[metric].Lock()
-				s._indexes[metric] = newInvertedIndex()
-				s._indexes[metric].Index(newPoints)
+				s._history[metric].Insert(snapshot.T, snapshot.Index)
 				s._ilocks[metric].Unlock()
+				if s._persist != nil {
+					select {
+					case s._persist <- snapshotUpdate{metric, snapshot}:
+					default:
+						s.logf("could not persist snapshot of %s: too many snapshots waiting for the store", metric)
+					}
+				}
 			default:
 			}
 		}
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-s._done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+//snapshotPrefix is the prefix of the store keys of the snapshots of a metric.
+func snapshotPrefix(metric string) []byte {
+	return []byte("snapshot/" + metric + "/")
+}
+
+//snapshotKey is the store key of a snapshot. The timestamp is zero-padded so that keys sort by time.
+func snapshotKey(metric string, t time.Time) []byte {
+	return []byte(fmt.Sprintf("snapshot/%s/%020d", metric, t.UnixNano()))
+}
+
+type snapshotUpdate struct {
+	metric   string
+	snapshot *timeSeriesItem
+}
+
+//persistSnapshots writes the snapshots sent by listenForChanges through the store, until it exits.
+func (s *Server) persistSnapshots() {
+	defer close(s._persistDone)
+	for u := range s._persist {
+		s.persistSnapshot(u.metric, u.snapshot)
+	}
+}
+
+//persistSnapshot writes the snapshot through the store and deletes the persisted snapshots that
+//no longer fit in the history. Errors are logged rather than returned so that a failing store
+//doesn't stop the API from serving fresh data.
+func (s *Server) persistSnapshot(metric string, snapshot *timeSeriesItem) {
+	b, err := snapshot.Marshal()
+	if err != nil {
+		s.logf("could not marshal snapshot of %s: %v", metric, err)
+		return
+	}
+	if err := s.store.Put(snapshotKey(metric, snapshot.T), b); err != nil {
+		s.logf("could not persist snapshot of %s: %v", metric, err)
+		return
+	}
+	keys, err := s.store.Keys(snapshotPrefix(metric))
+	if err != nil {
+		s.logf("could not list snapshots of %s: %v", metric, err)
+		return
+	}
+	for len(keys) > s.historySize {
+		if err := s.store.Delete(keys[0]); err != nil {
+			s.logf("could not delete snapshot %s: %v", keys[0], err)
+			return
+		}
+		keys = keys[1:]
+	}
+}
+
+//restoreSnapshots loads the persisted history of every metric, so that the API can answer
+//queries before the updaters have published anything. Snapshots that can't be read are skipped.
+func (s *Server) restoreSnapshots() {
+	for _, metric := range s.metrics {
+		keys, err := s.store.Keys(snapshotPrefix(metric.Name))
+		if err != nil {
+			s.logf("could not list snapshots of %s: %v", metric.Name, err)
+			continue
+		}
+		if len(keys) > s.historySize {
+			keys = keys[len(keys)-s.historySize:]
+		}
+		for _, key := range keys {
+			b, err := s.store.Get(key)
+			if err != nil {
+				s.logf("could not restore snapshot %s: %v", key, err)
+				continue
+			}
+			if b == nil {
+				continue
+			}
+			snapshot, err := unmarshalTimeSeriesItem(b)
+			if err != nil {
+				s.logf("could not unmarshal snapshot %s: %v", key, err)
+				continue
+			}
+			s._ilocks[metric.Name].Lock()
+			s._history[metric.Name].Insert(snapshot.T, snapshot.Index)
+			s._ilocks[metric.Name].Unlock()
+		}
+		s.logf("restored %d snapshots of %s", len(keys), metric.Name)
 	}
 }
 
-//StopUpdaters sends a stop signal to the metric updaters.
+//StopUpdaters sends a stop signal to the metric updaters. It does not wait for them to exit: use
+//Shutdown() for that.
 func (s *Server) StopUpdaters() {
-	for _, stopChan := range s._stopChans {
-		stopChan <- true
+	for _, u := range s._updaters {
+		u.signal()
 	}
 }
 
-//Serve serves the HTTP/JSON API.
-func (s *Server) Serve(port int) error {
+//ShutdownError is returned by Shutdown when one or more updaters did not stop before the
+//context expired.
+type ShutdownError struct {
+	Metrics []string //Metrics whose updaters failed to stop
+	Err     error    //Error of the expired context
+}
+
+func (e *ShutdownError) Error() string {
+	return "updaters failed to stop: " + strings.Join(e.Metrics, ", ") + ": " + e.Err.Error()
+}
+
+//Shutdown gracefully shuts down the server. If the API is being served by Serve(), it stops
+//listening and waits for in-flight queries to complete. It then signals every updater to stop
+//and waits for them until ctx expires, before stopping the goroutine that indexes their updates and,
+//once the pending snapshots are written, closing the store.
+//If some updaters did not stop in time the returned error is a *ShutdownError listing their metrics.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var httpErr error
+	s._lock.Lock()
+	srv := s._httpServer
+	s._lock.Unlock()
+	if srv != nil {
+		httpErr = srv.Shutdown(ctx)
+	}
+
+	if s._updateChans == nil {
+		//updaters were never started
+		return httpErr
+	}
+
+	s.StopUpdaters()
+	var failed []string
+	for _, u := range s._updaters {
+		select {
+		case <-u.done:
+		case <-ctx.Done():
+			select {
+			case <-u.done:
+			default:
+				failed = append(failed, u.metric)
+			}
+		}
+	}
+
+	s._stopFanIn.Do(func() {
+		close(s._done)
+	})
+	select {
+	case <-s._fanInDone:
+		if s.store == nil {
+			break
+		}
+		select {
+		case <-s._persistDone:
+			//nothing else writes to the store
+			if err := s.store.Close(); err != nil && httpErr == nil {
+				httpErr = err
+			}
+		case <-ctx.Done():
+			if httpErr == nil {
+				httpErr = ctx.Err()
+			}
+		}
+	case <-ctx.Done():
+		if httpErr == nil {
+			httpErr = ctx.Err()
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ShutdownError{Metrics: failed, Err: ctx.Err()}
+	}
+	return httpErr
+}
+
+//Handler returns an http.Handler serving the HTTP/JSON API, so that it can be mounted
+//in an existing mux, wrapped in middleware or served by an httptest.Server. It does not
+//start the metric updaters: call Start() for that.
+func (s *Server) Handler() (http.Handler, error) {
 	var err error
 	mms := metricListResponse{
 		Metrics: s.metrics,
@@ -408,28 +945,59 @@ func (s *Server) Serve(port int) error {
 	}
 	//Cache all the metadata
 	if s._mms, err = json.Marshal(mms); err != nil {
-		return err
+		return nil, err
 	}
 	if s._tms, err = json.Marshal(tts); err != nil {
-		return err
+		return nil, err
 	}
 
-	handler := regexpHandler{}
-	handler.Route("/$", s.indexHandler).Route("/metrics/*$", s.metricsIndexHandler).Route("/tags/*$", s.tagsIndexHandler) //metadata, the order doesn't matter
+	handler := &regexpHandler{}
+	handler.Route("^/$", s.indexHandler).Route("^/metrics/*$", s.metricsIndexHandler).Route("^/tags/*$", s.tagsIndexHandler) //metadata, the order doesn't matter
+
+	handler.Route("^/export/prometheus/*$", s.prometheusExportHandler)
+	handler.Route("^/points/([^/]+)/*$", s.pointsHandler)
+	handler.Route("^/distinct/([^/]+)/([^/]+)/*$", s.distinctHandler)
+
+	if s.ingestion {
+		handler.Route("^/ingest/([^/]+)/*$", s.ingestHandler)
+		handler.Route("^/write/*$", s.lineProtocolHandler)
+	}
+
+	handler.Route("^/top/([^/]+)/.+", s.topHandlerWrapper(handler))
 
 	for aggregateName := range s.aggregates {
-		handler.Route("/("+aggregateName+")/(.+)/by/(.+)/*", s.metricGroupByHandlerWrapper(aggregateName))
-		handler.Route("/("+aggregateName+")/(.+)/*", s.totalAggHandlerWrapper(aggregateName))
+		//the time-bucketed routes must come first as they also match the others
+		handler.Route("^/("+aggregateName+")/(.+)/over/([^/]+)/*$", s.seriesHandlerWrapper(aggregateName))
+		handler.Route("^/("+aggregateName+")/(.+)/by/(.+)/*", s.metricGroupByHandlerWrapper(aggregateName))
+		handler.Route("^/("+aggregateName+")/(.+)/*", s.totalAggHandlerWrapper(aggregateName))
 		s.logf("Added aggregate %s", aggregateName)
 	}
 
-	handler.Route("/.+/.+", s.unknownAggregateHandler)
-	handler.Route("/", s.catchallHandler)
+	handler.Route("^/.+/.+", s.unknownAggregateHandler)
+	handler.Route("^/", s.catchallHandler)
 
-	if err := s.startUpdaters(); err != nil {
+	return handler, nil
+}
+
+//Serve starts the metric updaters and serves the HTTP/JSON API on the given port. It blocks until
+//the server fails or Shutdown() is called, in which case it returns nil.
+func (s *Server) Serve(port int) error {
+	handler, err := s.Handler()
+	if err != nil {
 		return err
 	}
 
-	http.ListenAndServe(":"+strconv.Itoa(port), &handler)
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: handler}
+	s._lock.Lock()
+	s._httpServer = srv
+	s._lock.Unlock()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,496 @@
+package metrik
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dummyUpdater(points Points) Updater {
+	return func(result chan Points, stop chan bool) error {
+		result <- points
+		<-stop
+		return nil
+	}
+}
+
+func dummyPoints(n int) Points {
+	m := make(Points, n)
+	for i := range m {
+		m[i] = Point{
+			Tags:  map[string][]string{"rack": []string{strconv.Itoa(i % 2)}},
+			Value: 1.0,
+		}
+	}
+	return m
+}
+
+//dummyServer starts a server with a cpu metric whose updater publishes the points once.
+func dummyServer(t *testing.T, points Points) (*Server, *httptest.Server) {
+	s := NewServer()
+	s.Metric(&Metric{Name: "cpu", UpdateFunc: dummyUpdater(points)})
+	s.Tag(&Tag{Name: "rack"})
+	return s, startServer(t, s)
+}
+
+//startServer serves the API of the configured server s and starts its updaters.
+func startServer(t *testing.T, s *Server) *httptest.Server {
+	handler, err := s.Handler()
+	if err != nil {
+		t.Fatalf("unexpected error building handler: %v", err)
+	}
+	ts := httptest.NewServer(handler)
+	if err := s.Start(); err != nil {
+		ts.Close()
+		t.Fatalf("unexpected error starting updaters: %v", err)
+	}
+	return ts
+}
+
+//get polls the url until it returns a 200 or the deadline expires, then decodes the body into v.
+func get(t *testing.T, url string, v interface{}) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("unexpected error in GET %s: %v", url, err)
+		}
+		if resp.StatusCode == 200 {
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("could not decode response to GET %s: %v", url, err)
+			}
+			return
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status 200 for GET %s, instead got %v", url, resp.StatusCode)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	var total TotalAggregateResponse
+	get(t, ts.URL+"/sum/cpu", &total)
+	if len(total.Metrics) != 1 || total.Metrics[0].Value != 10 {
+		t.Errorf("expected sum to be 10, instead got %+v", total)
+	}
+
+	var groupby GroupbyAggregateResponse
+	get(t, ts.URL+"/count/cpu/by/rack", &groupby)
+	if len(groupby.Metrics) != 1 || len(groupby.Metrics[0].Groups) != 2 {
+		t.Fatalf("expected 2 groups, instead got %+v", groupby)
+	}
+	for _, g := range groupby.Metrics[0].Groups {
+		if g.Value != 5 {
+			t.Errorf("expected count to be 5, instead got %v", g.Value)
+		}
+	}
+}
+
+func TestHandlerPoints(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	var points PointsResponse
+	get(t, ts.URL+"/points/cpu?rack=1", &points)
+	if len(points.Metrics) != 1 || len(points.Metrics[0].Points) != 5 {
+		t.Fatalf("expected 5 points, instead got %+v", points)
+	}
+	if p := points.Metrics[0].Points[0]; p.Value != 1 || p.Tags["rack"][0] != "1" {
+		t.Errorf("unexpected point %+v", p)
+	}
+}
+
+func TestHandlerCompositeGroupBy(t *testing.T) {
+	points := dummyPoints(10)
+	for i := range points {
+		points[i].Tags["type"] = []string{strconv.Itoa(i % 5)}
+	}
+	s, ts := dummyServer(t, points)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	var groupby GroupbyAggregateResponse
+	get(t, ts.URL+"/count/cpu/by/rack,type", &groupby)
+	if len(groupby.Metrics) != 1 || len(groupby.Metrics[0].Groups) != 10 {
+		t.Fatalf("expected 10 groups, instead got %+v", groupby)
+	}
+	for _, g := range groupby.Metrics[0].Groups {
+		if len(g.Keys) != 2 || g.Value != 1 {
+			t.Errorf("unexpected group %+v", g)
+		}
+	}
+}
+
+func TestHandlerTop(t *testing.T) {
+	points := dummyPoints(10)
+	for i := range points {
+		points[i].Value = float64(i)
+	}
+	s, ts := dummyServer(t, points)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	//rack 0 has 0+2+4+6+8 = 20, rack 1 has 25
+	var groupby GroupbyAggregateResponse
+	get(t, ts.URL+"/top/1/sum/cpu/by/rack", &groupby)
+	if len(groupby.Metrics) != 1 || len(groupby.Metrics[0].Groups) != 1 || groupby.Metrics[0].Groups[0].Key != "1" {
+		t.Errorf("expected rack 1, instead got %+v", groupby)
+	}
+	get(t, ts.URL+"/sum/cpu/by/rack?sort=value&limit=1", &groupby)
+	if len(groupby.Metrics[0].Groups) != 1 || groupby.Metrics[0].Groups[0].Key != "0" {
+		t.Errorf("expected rack 0, instead got %+v", groupby)
+	}
+	resp, err := http.Get(ts.URL + "/top/1/sum/cpu")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("expected top without group-by to be rejected, instead got %v", resp.StatusCode)
+	}
+}
+
+func TestHandlerHaving(t *testing.T) {
+	points := dummyPoints(10)
+	for i := range points {
+		points[i].Value = float64(i)
+	}
+	s, ts := dummyServer(t, points)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	//rack 0 has 0+2+4+6+8 = 20, rack 1 has 25
+	var groupby GroupbyAggregateResponse
+	get(t, ts.URL+"/sum/cpu/by/rack?having=value>20", &groupby)
+	if len(groupby.Metrics) != 1 || len(groupby.Metrics[0].Groups) != 1 || groupby.Metrics[0].Groups[0].Key != "1" {
+		t.Errorf("expected rack 1, instead got %+v", groupby)
+	}
+}
+
+func TestHandlerEmptyGroups(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	var groupby GroupbyAggregateResponse
+	get(t, ts.URL+"/average/cpu/by/rack?rack=1", &groupby)
+	if len(groupby.Metrics) != 1 || len(groupby.Metrics[0].Groups) != 2 || groupby.Metrics[0].Groups[0].Count != 0 {
+		t.Errorf("expected rack 0 to be empty, instead got %+v", groupby)
+	}
+	get(t, ts.URL+"/average/cpu/by/rack?rack=1&empty=omit", &groupby)
+	if len(groupby.Metrics[0].Groups) != 1 || groupby.Metrics[0].Groups[0].Count != 5 {
+		t.Errorf("expected only rack 1, instead got %+v", groupby)
+	}
+}
+
+func TestHandlerDistinct(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	var distinct TotalAggregateResponse
+	get(t, ts.URL+"/distinct/cpu/rack", &distinct)
+	if len(distinct.Metrics) != 1 || distinct.Metrics[0].Value != 2 {
+		t.Fatalf("expected 2 racks, instead got %+v", distinct)
+	}
+	get(t, ts.URL+"/distinct/cpu/rack?rack=1", &distinct)
+	if distinct.Metrics[0].Value != 1 {
+		t.Errorf("expected 1 rack, instead got %+v", distinct)
+	}
+}
+
+func TestHandlerReservedTag(t *testing.T) {
+	points := dummyPoints(10)
+	for i := range points {
+		points[i].Tags["from"] = []string{strconv.Itoa(i % 5)}
+	}
+	s, ts := dummyServer(t, points)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	var total TotalAggregateResponse
+	get(t, ts.URL+"/count/cpu?tag:from=1", &total)
+	if len(total.Metrics) != 1 || total.Metrics[0].Value != 2 {
+		t.Errorf("expected count to be 2, instead got %+v", total)
+	}
+	resp, err := http.Get(ts.URL + "/count/cpu?from=1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 400 {
+		t.Errorf("expected ambiguous parameter to be rejected, instead got %v", resp.StatusCode)
+	}
+}
+
+func TestHandlerNotFound(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	resp, err := http.Get(ts.URL + "/sum/memory")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("expected status 404 for unknown metric, instead got %v", resp.StatusCode)
+	}
+}
+
+func TestHandlerHistory(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	var total TotalAggregateResponse
+	get(t, ts.URL+"/sum/cpu", &total)
+	now := time.Now().UTC()
+
+	get(t, ts.URL+"/sum/cpu?at="+now.Format(time.RFC3339Nano), &total)
+	if len(total.Metrics) != 1 || total.Metrics[0].Value != 10 {
+		t.Errorf("expected sum to be 10, instead got %+v", total)
+	}
+
+	var series TotalAggregateSeriesResponse
+	get(t, ts.URL+"/sum/cpu?from="+now.Add(-time.Hour).Format(time.RFC3339Nano), &series)
+	if len(series.Metrics) != 1 || len(series.Metrics[0].Series) != 1 || series.Metrics[0].Series[0].Value != 10 {
+		t.Errorf("expected a single snapshot with sum 10, instead got %+v", series)
+	}
+
+	stamp, hourAgo := now.Format(time.RFC3339), now.Add(-time.Hour).Format(time.RFC3339)
+	for url, status := range map[string]int{
+		"/sum/cpu?at=" + hourAgo:                        404,
+		"/sum/cpu?at=yesterday":                         400,
+		"/sum/cpu/by/rack?at=" + stamp + "&to=" + stamp: 400,
+	} {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expected status %v for %s, instead got %v", status, url, resp.StatusCode)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	t0 := time.Date(2016, 10, 17, 10, 0, 0, 0, time.UTC)
+	var snapshots []*timeSeriesItem
+	for _, offset := range []time.Duration{0, 2 * time.Minute, 4 * time.Minute, 12 * time.Minute} {
+		snapshots = append(snapshots, &timeSeriesItem{T: t0.Add(offset)})
+	}
+	starts, buckets := bucket(snapshots, 5*time.Minute)
+	if len(starts) != 2 || len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, instead got %v", len(buckets))
+	}
+	if !starts[0].Equal(t0) || len(buckets[0]) != 3 {
+		t.Errorf("expected 3 snapshots from 10:00, instead got %v from %v", len(buckets[0]), starts[0])
+	}
+	if !starts[1].Equal(t0.Add(10*time.Minute)) || len(buckets[1]) != 1 {
+		t.Errorf("expected 1 snapshot from 10:10, instead got %v from %v", len(buckets[1]), starts[1])
+	}
+}
+
+func TestHandlerOver(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	//the series routes answer with an empty series until the first snapshot is indexed
+	var latest TotalAggregateResponse
+	get(t, ts.URL+"/sum/cpu", &latest)
+
+	var total TotalAggregateSeriesResponse
+	get(t, ts.URL+"/sum/cpu/over/5m?from=-1h&reduce=sum", &total)
+	if len(total.Metrics) != 1 || len(total.Metrics[0].Series) != 1 || total.Metrics[0].Series[0].Value != 10 {
+		t.Errorf("expected a single bucket with sum 10, instead got %+v", total)
+	}
+
+	var groupby GroupbyAggregateSeriesResponse
+	get(t, ts.URL+"/count/cpu/by/rack/over/5m", &groupby)
+	if len(groupby.Metrics) != 1 || len(groupby.Metrics[0].Series) != 1 {
+		t.Fatalf("expected a single bucket, instead got %+v", groupby)
+	}
+	if groups := groupby.Metrics[0].Series[0].Groups; len(groups) != 2 || groups[0].Key != "0" || groups[0].Value != 5 {
+		t.Errorf("expected 2 groups with count 5, instead got %+v", groups)
+	}
+
+	for _, url := range []string{"/sum/cpu/over/yesterday", "/sum/cpu/over/5m?reduce=unknown"} {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("expected status 400 for %s, instead got %v", url, resp.StatusCode)
+		}
+	}
+}
+
+func TestRestoreSnapshots(t *testing.T) {
+	st := newInMemoryStore()
+	s1 := NewServer().Store(st)
+	s1.Metric(&Metric{Name: "cpu", UpdateFunc: dummyUpdater(dummyPoints(10))})
+	ts1 := startServer(t, s1)
+	var total TotalAggregateResponse
+	get(t, ts1.URL+"/sum/cpu", &total)
+	ts1.Close()
+	if err := s1.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+
+	//the second server's updater never publishes anything
+	s2 := NewServer().Store(st)
+	s2.Metric(&Metric{Name: "cpu", UpdateFunc: func(result chan Points, stop chan bool) error {
+		<-stop
+		return nil
+	}})
+	ts2 := startServer(t, s2)
+	defer ts2.Close()
+	defer s2.StopUpdaters()
+
+	resp, err := http.Get(ts2.URL + "/sum/cpu")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected restored snapshot to be served, instead got status %v", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&total); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	if len(total.Metrics) != 1 || total.Metrics[0].Value != 10 {
+		t.Errorf("expected sum to be 10, instead got %+v", total)
+	}
+}
+
+//blockingStore is a store whose writes block until it is released.
+type blockingStore struct {
+	Store
+	release chan struct{}
+}
+
+func (st blockingStore) Put(key []byte, value []byte) error {
+	<-st.release
+	return st.Store.Put(key, value)
+}
+
+func TestSlowStore(t *testing.T) {
+	st := blockingStore{Store: newInMemoryStore(), release: make(chan struct{})}
+	s := NewServer().Store(st)
+	s.Metric(&Metric{Name: "cpu", UpdateFunc: dummyUpdater(dummyPoints(10))})
+	ts := startServer(t, s)
+	defer ts.Close()
+
+	//the update is served while its snapshot is waiting for the store
+	var total TotalAggregateResponse
+	get(t, ts.URL+"/sum/cpu", &total)
+	if len(total.Metrics) != 1 || total.Metrics[0].Value != 10 {
+		t.Errorf("expected sum to be 10, instead got %+v", total)
+	}
+	close(st.release)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+	if keys, _ := st.Keys(snapshotPrefix("cpu")); len(keys) != 1 {
+		t.Errorf("expected the snapshot to be persisted before shutting down, instead got %v", keys)
+	}
+}
+
+type writeOnlyAuth struct{}
+
+func (a writeOnlyAuth) Authorize(r *AuthRequest) (bool, *AuthError) {
+	return !r.Write || r.User == "writer", nil
+}
+
+func TestIngest(t *testing.T) {
+	s := NewServer().Ingestion(true).Auth(writeOnlyAuth{})
+	s.Metric(&Metric{Name: "cpu"})
+	ts := startServer(t, s)
+	defer ts.Close()
+	defer s.StopUpdaters()
+
+	body := `[{"tags": {"rack": ["0"]}, "value": 1.5}, {"tags": {"rack": ["1"]}, "value": 2.5}]`
+	for user, status := range map[string]int{"reader": 403, "writer": 202} {
+		req, _ := http.NewRequest("POST", ts.URL+"/ingest/cpu", strings.NewReader(body))
+		req.SetBasicAuth(user, "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expected status %v for %s, instead got %v", status, user, resp.StatusCode)
+		}
+	}
+
+	var total TotalAggregateResponse
+	get(t, ts.URL+"/sum/cpu", &total)
+	if len(total.Metrics) != 1 || total.Metrics[0].Value != 4 {
+		t.Errorf("expected sum to be 4, instead got %+v", total)
+	}
+
+	for url, status := range map[string]int{"/ingest/memory": 404, "/ingest/cpu?bad": 400} {
+		req, _ := http.NewRequest("POST", ts.URL+url, strings.NewReader(`{"not": "points"}`))
+		req.SetBasicAuth("writer", "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expected status %v for %s, instead got %v", status, url, resp.StatusCode)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, ts := dummyServer(t, dummyPoints(10))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("expected clean shutdown, instead got %v", err)
+	}
+	//stopping again should not block
+	s.StopUpdaters()
+}
+
+func TestShutdownStuckUpdater(t *testing.T) {
+	s := NewServer()
+	s.Metric(&Metric{Name: "cpu", UpdateFunc: dummyUpdater(dummyPoints(10))})
+	s.Metric(&Metric{Name: "stuck", UpdateFunc: func(result chan Points, stop chan bool) error {
+		select {} //ignores the stop signal
+	}})
+	if err := s.Start(); err != nil {
+		t.Fatalf("unexpected error starting updaters: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	serr, ok := err.(*ShutdownError)
+	if !ok {
+		t.Fatalf("expected a *ShutdownError, instead got %v", err)
+	}
+	if len(serr.Metrics) != 1 || serr.Metrics[0] != "stuck" {
+		t.Errorf("expected only the stuck updater to fail to stop, instead got %v", serr.Metrics)
+	}
+}
@@ -0,0 +1,237 @@
+package metrik
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//maxStatsdPacket is the largest UDP packet the StatsD listener reads.
+const maxStatsdPacket = 65535
+
+//statsdExpiry is the number of flushes after which a tag set that received no samples is dropped.
+const statsdExpiry = 10
+
+//StatsdUpdater is an Updater that listens for StatsD metrics on a UDP address (eg. ":8125"),
+//and every flush interval publishes the metric called name as one point per distinct tag set.
+//Tags are given in the DogStatsD format, eg. "power:1.5|g|#region:uk,asset:battery".
+//
+//Gauges (|g) keep their last value across flushes, and can be incremented or decremented by
+//prefixing the value with + or -. Counters (|c) are summed over the flush interval, taking
+//any sample rate (|@0.1) into account, and reset to zero after every flush. A tag set that
+//receives no samples for statsdExpiry flushes is dropped. Nothing is published until the first
+//sample arrives, but after that every flush is published, even if it is empty. Other metric
+//types, and other metric names, are ignored.
+func StatsdUpdater(addr string, name string, flush time.Duration) Updater {
+	return func(result chan Points, stop chan bool) error {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		acc := newStatsdAccumulator(name)
+		readErr := make(chan error, 1)
+		go func() {
+			readErr <- acc.read(conn)
+		}()
+
+		ticker := time.NewTicker(flush)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				points, ok := acc.flush()
+				if !ok {
+					//nothing received yet
+					continue
+				}
+				select {
+				case result <- points:
+				case <-stop:
+					return nil
+				}
+			case err := <-readErr:
+				return err
+			case <-stop:
+				return nil
+			}
+		}
+	}
+}
+
+type statsdValue struct {
+	tags  Tags
+	value float64
+	idle  int //number of flushes since the last sample
+}
+
+//statsdAccumulator collects the values of a single StatsD metric, by tag set, between flushes.
+type statsdAccumulator struct {
+	sync.Mutex
+	name     string
+	received bool
+	gauges   map[string]*statsdValue
+	counters map[string]*statsdValue
+}
+
+func newStatsdAccumulator(name string) *statsdAccumulator {
+	return &statsdAccumulator{
+		name:     name,
+		gauges:   make(map[string]*statsdValue),
+		counters: make(map[string]*statsdValue),
+	}
+}
+
+//read reads packets from the connection until it is closed.
+func (a *statsdAccumulator) read(conn net.PacketConn) error {
+	buf := make([]byte, maxStatsdPacket)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			a.add(line)
+		}
+	}
+}
+
+//add parses a line and accumulates its value if it is a gauge or counter of the metric.
+//Malformed lines are ignored, as there is nobody to report them to.
+func (a *statsdAccumulator) add(line string) {
+	sample, err := parseStatsdLine(line)
+	if err != nil || sample.name != a.name {
+		return
+	}
+	key := tagsKey(sample.tags)
+	a.Lock()
+	defer a.Unlock()
+	switch sample.kind {
+	case "g":
+		if v, ok := a.gauges[key]; ok && sample.delta {
+			v.value += sample.value
+			v.idle = 0
+		} else {
+			a.gauges[key] = &statsdValue{tags: sample.tags, value: sample.value}
+		}
+	case "c":
+		if v, ok := a.counters[key]; ok {
+			v.value += sample.value
+			v.idle = 0
+		} else {
+			a.counters[key] = &statsdValue{tags: sample.tags, value: sample.value}
+		}
+	default:
+		return
+	}
+	a.received = true
+}
+
+//flush returns the accumulated points, resets the counters to zero and drops the tag sets that
+//expired. It returns false if no sample was ever received.
+func (a *statsdAccumulator) flush() (Points, bool) {
+	a.Lock()
+	defer a.Unlock()
+	points := make(Points, 0, len(a.gauges)+len(a.counters))
+	for _, values := range []map[string]*statsdValue{a.gauges, a.counters} {
+		keys := make([]string, 0, len(values))
+		for key, v := range values {
+			if v.idle >= statsdExpiry {
+				delete(values, key)
+				continue
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			points = append(points, Point{Tags: values[key].tags, Value: values[key].value})
+			values[key].idle++
+		}
+	}
+	for _, v := range a.counters {
+		v.value = 0
+	}
+	return points, a.received
+}
+
+type statsdSample struct {
+	name  string
+	kind  string //g or c (or another, ignored, StatsD type)
+	value float64
+	delta bool //gauge increment/decrement
+	tags  Tags
+}
+
+//parseStatsdLine parses a line of the form name:value|type[|@sample_rate][|#tag:value,...]
+func parseStatsdLine(line string) (statsdSample, error) {
+	var sample statsdSample
+	line = strings.TrimSpace(line)
+	colon := strings.IndexByte(line, ':')
+	if colon < 1 {
+		return sample, errors.New("missing metric name")
+	}
+	sample.name = line[:colon]
+	sections := strings.Split(line[colon+1:], "|")
+	if len(sections) < 2 {
+		return sample, errors.New("missing metric type")
+	}
+	value, kind := sections[0], sections[1]
+	sample.kind = kind
+	sample.delta = kind == "g" && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-"))
+	var err error
+	if sample.value, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+		return sample, errors.New("invalid value - " + value)
+	}
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return sample, errors.New("invalid sample rate - " + section)
+			}
+			if kind == "c" {
+				sample.value /= rate
+			}
+		case strings.HasPrefix(section, "#"):
+			sample.tags = make(Tags)
+			for _, tag := range strings.Split(section[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 1 {
+					kv = append(kv, "")
+				}
+				sample.tags[kv[0]] = append(sample.tags[kv[0]], kv[1])
+			}
+		}
+	}
+	return sample, nil
+}
+
+//tagsKey returns a canonical string representation of the tags, so that tag sets can be compared.
+func tagsKey(t Tags) string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		values := append([]string{}, t[key]...)
+		sort.Strings(values)
+		b.WriteString(strconv.Quote(key))
+		for _, value := range values {
+			b.WriteByte(',')
+			b.WriteString(strconv.Quote(value))
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
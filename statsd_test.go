@@ -0,0 +1,116 @@
+package metrik
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdAccumulator(t *testing.T) {
+	acc := newStatsdAccumulator("power")
+	for _, line := range []string{
+		"power:10|g|#region:uk",
+		"power:+5|g|#region:uk",
+		"power:3|g|#region:fr,asset:battery",
+		"power:1|c|@0.5|#region:uk",
+		"power:2|c|#region:uk",
+		"power:1|ms|#region:uk",
+		"cpu:1|g",
+		"power:abc|g",
+		"power:NaN|g",
+		"power:+Inf|g|#region:uk",
+		"power:-Inf|c|#region:uk",
+		"power:1|c|@NaN|#region:uk",
+		"garbage",
+	} {
+		acc.add(line)
+	}
+	points, _ := acc.flush()
+	if len(points) != 3 {
+		t.Fatalf("expected 3 points, instead got %+v", points)
+	}
+	var total float64
+	for _, p := range points {
+		total += p.Value
+	}
+	//gauges 15 and 3, counter 1/0.5+2
+	if total != 22 {
+		t.Errorf("expected points to sum to 22, instead got %+v", points)
+	}
+	//counters are reset to zero, gauges are kept
+	points, _ = acc.flush()
+	total = 0
+	for _, p := range points {
+		total += p.Value
+	}
+	if len(points) != 3 || total != 18 {
+		t.Errorf("expected the 2 gauges and a zero counter after flush, instead got %+v", points)
+	}
+}
+
+func TestStatsdFlushWithoutCounters(t *testing.T) {
+	acc := newStatsdAccumulator("requests")
+	if _, ok := acc.flush(); ok {
+		t.Errorf("expected nothing to publish before the first sample")
+	}
+	acc.add("requests:3|c|#region:uk")
+	if points, ok := acc.flush(); !ok || len(points) != 1 || points[0].Value != 3 {
+		t.Errorf("expected the counter to be published, instead got %+v", points)
+	}
+	//no traffic, the counter is published as zero until it expires
+	for i := 1; i < statsdExpiry; i++ {
+		if points, ok := acc.flush(); !ok || len(points) != 1 || points[0].Value != 0 {
+			t.Fatalf("expected a zero counter after %v flushes, instead got %+v", i, points)
+		}
+	}
+	if points, ok := acc.flush(); !ok || len(points) != 0 {
+		t.Errorf("expected an empty set to be published after the counter expired, instead got %+v", points)
+	}
+	//gauges expire too
+	acc.add("requests:1|g")
+	for i := 0; i < statsdExpiry; i++ {
+		acc.flush()
+	}
+	if points, _ := acc.flush(); len(points) != 0 {
+		t.Errorf("expected the gauge to expire, instead got %+v", points)
+	}
+}
+
+func TestStatsdUpdater(t *testing.T) {
+	//find a free port
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	result, stop, done := make(chan Points, 1), make(chan bool), make(chan error)
+	go func() {
+		done <- StatsdUpdater(addr, "power", 50*time.Millisecond)(result, stop)
+	}()
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer client.Close()
+	deadline := time.After(2 * time.Second)
+	for {
+		client.Write([]byte("power:1.5|g|#region:uk\npower:2|g|#region:fr"))
+		select {
+		case points := <-result:
+			if len(points) != 2 || points[0].Tags["region"][0] != "fr" || points[1].Value != 1.5 {
+				t.Errorf("unexpected points %+v", points)
+			}
+			close(stop)
+			if err := <-done; err != nil {
+				t.Errorf("unexpected error stopping updater: %v", err)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("expected points to be published")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
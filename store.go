@@ -1,14 +1,24 @@
 package metrik
 
 import (
+	"bytes"
+	"sort"
 	"sync"
 )
 
 //Store represents a storage mechanism for the metric data. Any key-value store will do.
+//The server writes a snapshot of each metric to the store every time it is updated, prunes
+//those that fall out of its history, and restores them when it starts.
 type Store interface {
 	Initialize(...interface{}) error //Initialize the store
 	Put([]byte, []byte) error        //Put value
-	Get([]byte) ([]byte, error)      //Retrieve value
+	Get([]byte) ([]byte, error)      //Retrieve value. The value should be nil if the key doesn't exist.
+	Delete([]byte) error             //Delete value. Deleting a key that doesn't exist is not an error.
+	Keys([]byte) ([][]byte, error)   //List keys starting with the prefix, in increasing order
+	//Range calls the function on every key-value pair with start <= key < end, in increasing order
+	//of keys, until it returns false. A nil end means there is no upper bound.
+	Range(start []byte, end []byte, f func([]byte, []byte) bool) error
+	Close() error //Close the store, releasing any resources
 }
 
 type inMemoryStore struct {
@@ -16,6 +26,13 @@ type inMemoryStore struct {
 	store map[string][]byte
 }
 
+func newInMemoryStore() *inMemoryStore {
+	return &inMemoryStore{
+		RWMutex: &sync.RWMutex{},
+		store:   make(map[string][]byte),
+	}
+}
+
 func (i inMemoryStore) Initialize(...interface{}) error {
 	return nil
 }
@@ -32,3 +49,62 @@ func (i inMemoryStore) Get(key []byte) ([]byte, error) {
 	defer i.RUnlock()
 	return i.store[string(key)], nil
 }
+
+func (i inMemoryStore) Delete(key []byte) error {
+	i.Lock()
+	delete(i.store, string(key))
+	i.Unlock()
+	return nil
+}
+
+func (i inMemoryStore) Keys(prefix []byte) ([][]byte, error) {
+	i.RLock()
+	defer i.RUnlock()
+	var keys [][]byte
+	for key := range i.store {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+func (i inMemoryStore) Range(start []byte, end []byte, f func([]byte, []byte) bool) error {
+	type kv struct {
+		key, val []byte
+	}
+	var kvs []kv
+	//copy the pairs so that f can modify the store
+	i.RLock()
+	for key, val := range i.store {
+		if inRange([]byte(key), start, end) {
+			kvs = append(kvs, kv{[]byte(key), val})
+		}
+	}
+	i.RUnlock()
+	sort.Slice(kvs, func(a, b int) bool {
+		return bytes.Compare(kvs[a].key, kvs[b].key) < 0
+	})
+	for _, pair := range kvs {
+		if !f(pair.key, pair.val) {
+			break
+		}
+	}
+	return nil
+}
+
+func (i inMemoryStore) Close() error {
+	return nil
+}
+
+func sortKeys(keys [][]byte) {
+	sort.Slice(keys, func(a, b int) bool {
+		return bytes.Compare(keys[a], keys[b]) < 0
+	})
+}
+
+//inRange returns true if start <= key < end. A nil end means there is no upper bound.
+func inRange(key, start, end []byte) bool {
+	return bytes.Compare(key, start) >= 0 && (end == nil || bytes.Compare(key, end) < 0)
+}
@@ -0,0 +1,155 @@
+package metrik
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	st := NewFileStore(dir)
+	if err := st.Initialize(); err != nil {
+		t.Fatalf("unexpected error initializing store: %v", err)
+	}
+	if val, err := st.Get([]byte("snapshot/cpu")); val != nil || err != nil {
+		t.Errorf("expected nil value for missing key, instead got %v, %v", val, err)
+	}
+	for _, val := range []string{"first", "second", ""} {
+		if err := st.Put([]byte("snapshot/cpu"), []byte(val)); err != nil {
+			t.Fatalf("unexpected error in put: %v", err)
+		}
+		got, err := st.Get([]byte("snapshot/cpu"))
+		if err != nil || string(got) != val {
+			t.Errorf("expected %q, instead got %q, %v", val, got, err)
+		}
+	}
+}
+
+func TestFileStoreCorruption(t *testing.T) {
+	dir := t.TempDir()
+	st := NewFileStore(dir)
+	st.Initialize()
+	key := []byte("snapshot/cpu")
+	if err := st.Put(key, []byte("some value")); err != nil {
+		t.Fatalf("unexpected error in put: %v", err)
+	}
+	b, err := os.ReadFile(st.path(key))
+	if err != nil {
+		t.Fatalf("unexpected error reading value file: %v", err)
+	}
+	for name, corrupt := range map[string][]byte{
+		"flipped bit": append(append([]byte{}, b[:len(b)-1]...), b[len(b)-1]^1),
+		"truncated":   b[:len(b)-2],
+		"bad header":  b[2:],
+	} {
+		os.WriteFile(st.path(key), corrupt, 0644)
+		if _, err := st.Get(key); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected ErrCorrupt, instead got %v", name, err)
+		}
+	}
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+	//a write interrupted by a crash leaves a temporary file behind
+	tmp := filepath.Join(dir, "abcd.123"+fileStoreTmpExt)
+	os.WriteFile(tmp, []byte("partial"), 0644)
+	st := NewFileStore(dir)
+	if err := st.Initialize(); err != nil {
+		t.Fatalf("unexpected error initializing store: %v", err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file to be removed, instead got %v", err)
+	}
+}
+
+func testStoreScan(t *testing.T, st Store) {
+	for _, key := range []string{"snapshot/cpu/2", "snapshot/cpu/1", "snapshot/memory/1", "snapshot/cpu/3"} {
+		if err := st.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("unexpected error in put: %v", err)
+		}
+	}
+	keys, err := st.Keys([]byte("snapshot/cpu/"))
+	if err != nil || len(keys) != 3 || string(keys[0]) != "snapshot/cpu/1" || string(keys[2]) != "snapshot/cpu/3" {
+		t.Errorf("expected 3 sorted cpu keys, instead got %q, %v", keys, err)
+	}
+	var ranged []string
+	err = st.Range([]byte("snapshot/cpu/2"), []byte("snapshot/memory/"), func(key, val []byte) bool {
+		if string(key) != string(val) {
+			t.Errorf("expected value of %s to be the key, instead got %s", key, val)
+		}
+		ranged = append(ranged, string(key))
+		return true
+	})
+	if err != nil || len(ranged) != 2 || ranged[0] != "snapshot/cpu/2" || ranged[1] != "snapshot/cpu/3" {
+		t.Errorf("expected to range over cpu/2 and cpu/3, instead got %v, %v", ranged, err)
+	}
+	var n int
+	st.Range([]byte("snapshot/"), nil, func(key, val []byte) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("expected range to stop after 2 keys, instead got %v", n)
+	}
+	if err := st.Delete([]byte("snapshot/cpu/1")); err != nil {
+		t.Errorf("unexpected error in delete: %v", err)
+	}
+	if err := st.Delete([]byte("snapshot/cpu/1")); err != nil {
+		t.Errorf("expected deleting a missing key to succeed, instead got %v", err)
+	}
+	if keys, _ := st.Keys([]byte("snapshot/")); len(keys) != 3 {
+		t.Errorf("expected 3 keys after delete, instead got %q", keys)
+	}
+	if err := st.Close(); err != nil {
+		t.Errorf("unexpected error in close: %v", err)
+	}
+}
+
+func TestStoreScan(t *testing.T) {
+	testStoreScan(t, newInMemoryStore())
+	st := NewFileStore(t.TempDir())
+	st.Initialize()
+	testStoreScan(t, st)
+}
+
+func TestSnapshotPruning(t *testing.T) {
+	st := newInMemoryStore()
+	s := NewServer().Store(st).HistorySize(2)
+	s.Metric(&Metric{Name: "cpu"})
+	t0 := time.Date(2016, 10, 17, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		s.persistSnapshot("cpu", &timeSeriesItem{T: t0.Add(time.Duration(i) * time.Minute), Index: newInvertedIndex()})
+	}
+	keys, _ := st.Keys(snapshotPrefix("cpu"))
+	if len(keys) != 2 || string(keys[0]) != string(snapshotKey("cpu", t0.Add(time.Minute))) {
+		t.Fatalf("expected the 2 most recent snapshots to be kept, instead got %q", keys)
+	}
+
+	s.restoreSnapshots()
+	if series := s._history["cpu"]; len(*series) != 2 || !series.Latest().T.Equal(t0.Add(2*time.Minute)) {
+		t.Errorf("expected the 2 persisted snapshots to be restored, instead got %v", len(*series))
+	}
+}
+
+func TestSnapshotPruningMinimum(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		st := newInMemoryStore()
+		s := NewServer().Store(st).HistorySize(size)
+		s.Metric(&Metric{Name: "cpu"})
+		t0 := time.Date(2016, 10, 17, 10, 0, 0, 0, time.UTC)
+		for i := 0; i < 2; i++ {
+			s.persistSnapshot("cpu", &timeSeriesItem{T: t0.Add(time.Duration(i) * time.Minute), Index: newInvertedIndex()})
+		}
+		if keys, _ := st.Keys(snapshotPrefix("cpu")); len(keys) != 1 {
+			t.Fatalf("history size %v: expected the latest snapshot to be kept, instead got %q", size, keys)
+		}
+		s.restoreSnapshots()
+		if series := s._history["cpu"]; len(*series) != 1 || !series.Latest().T.Equal(t0.Add(time.Minute)) {
+			t.Errorf("history size %v: expected the latest snapshot to be restored, instead got %v", size, len(*series))
+		}
+	}
+}